@@ -0,0 +1,163 @@
+// admin.go 文件实现了管理接口。
+// 管理接口监听在独立的地址上，以 JSON 的形式返回每个后端的状态和已注册的能力，
+// 并支持重启、禁用单个后端以及触发配置重新加载。
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// ServerInfo 是管理接口返回的后端概要信息
+type ServerInfo struct {
+	ClientStatus
+	Uptime            string `json:"uptime,omitempty"`  // 当前连接已保持的时间
+	Tools             int    `json:"tools"`             // 已注册的工具数量
+	Prompts           int    `json:"prompts"`           // 已注册的提示数量
+	Resources         int    `json:"resources"`         // 已注册的资源数量
+	ResourceTemplates int    `json:"resourceTemplates"` // 已注册的资源模板数量
+}
+
+// ServerDetail 是管理接口返回的后端详细信息，包含已注册的全部能力
+type ServerDetail struct {
+	ServerInfo
+	ToolList             []mcp.Tool             `json:"toolList"`
+	PromptList           []mcp.Prompt           `json:"promptList"`
+	ResourceList         []mcp.Resource         `json:"resourceList"`
+	ResourceTemplateList []mcp.ResourceTemplate `json:"resourceTemplateList"`
+}
+
+// newAdminHandler 创建管理接口的 HTTP 处理器
+func newAdminHandler(p *proxy) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /servers", func(w http.ResponseWriter, r *http.Request) {
+		infos := make([]ServerInfo, 0)
+		for _, c := range p.clients() {
+			infos = append(infos, serverInfo(c))
+		}
+		writeJSON(w, http.StatusOK, infos)
+	})
+	mux.HandleFunc("GET /servers/{name}", withClient(p, func(w http.ResponseWriter, r *http.Request, c *Client) {
+		writeJSON(w, http.StatusOK, serverDetail(c))
+	}))
+	mux.HandleFunc("GET /servers/{name}/tools", withClient(p, func(w http.ResponseWriter, r *http.Request, c *Client) {
+		writeJSON(w, http.StatusOK, serverDetail(c).ToolList)
+	}))
+	mux.HandleFunc("GET /servers/{name}/prompts", withClient(p, func(w http.ResponseWriter, r *http.Request, c *Client) {
+		writeJSON(w, http.StatusOK, serverDetail(c).PromptList)
+	}))
+	mux.HandleFunc("GET /servers/{name}/resources", withClient(p, func(w http.ResponseWriter, r *http.Request, c *Client) {
+		detail := serverDetail(c)
+		writeJSON(w, http.StatusOK, map[string]any{
+			"resources":         detail.ResourceList,
+			"resourceTemplates": detail.ResourceTemplateList,
+		})
+	}))
+	mux.HandleFunc("GET /servers/{name}/stderr", withClient(p, func(w http.ResponseWriter, r *http.Request, c *Client) {
+		// 可以通过 lines 参数只返回最近的若干行
+		n, _ := strconv.Atoi(r.URL.Query().Get("lines"))
+		writeJSON(w, http.StatusOK, c.stderr.tail(n))
+	}))
+	mux.HandleFunc("POST /servers/{name}/restart", withClient(p, func(w http.ResponseWriter, r *http.Request, c *Client) {
+		// 重连失败时后端仍会在后台重试，这里只返回重启后的状态
+		if err := c.restartNow(); err != nil {
+			log.Printf("<%s> Restart failed: %v", c.name, err)
+		}
+		writeJSON(w, http.StatusOK, serverInfo(c))
+	}))
+	mux.HandleFunc("POST /servers/{name}/disable", withClient(p, func(w http.ResponseWriter, r *http.Request, c *Client) {
+		c.disable()
+		writeJSON(w, http.StatusOK, serverInfo(c))
+	}))
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Reload requested through admin API")
+		if err := p.reload(); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+	})
+	return mux
+}
+
+// withClient 根据路径中的服务器名称查找客户端，找不到时返回 404
+func withClient(p *proxy, next func(w http.ResponseWriter, r *http.Request, c *Client)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		c, ok := p.client(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("server %s not found", name))
+			return
+		}
+		next(w, r, c)
+	}
+}
+
+// serverInfo 返回客户端的概要信息
+func serverInfo(c *Client) ServerInfo {
+	status := c.status()
+	current := c.snapshot()
+	info := ServerInfo{
+		ClientStatus:      status,
+		Tools:             len(current.tools),
+		Prompts:           len(current.prompts),
+		Resources:         len(current.resources),
+		ResourceTemplates: len(current.resourceTemplates),
+	}
+	if status.State == ClientStateReady && status.ConnectedAt != nil {
+		info.Uptime = time.Since(*status.ConnectedAt).Round(time.Second).String()
+	}
+	return info
+}
+
+// serverDetail 返回客户端的详细信息
+func serverDetail(c *Client) ServerDetail {
+	current := c.snapshot()
+	return ServerDetail{
+		ServerInfo:           serverInfo(c),
+		ToolList:             slices.Clone(current.tools),
+		PromptList:           slices.Clone(current.prompts),
+		ResourceList:         slices.Clone(current.resources),
+		ResourceTemplateList: slices.Clone(current.resourceTemplates),
+	}
+}
+
+// writeJSON 以 JSON 格式写入响应
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+// writeError 以 JSON 格式写入错误响应
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// startAdminServer 在独立的地址上启动管理接口，复用路由的认证、日志和恢复中间件
+func startAdminServer(p *proxy, conf *AdminConfig) *http.Server {
+	options := &Options{
+		AuthTokens: conf.AuthTokens,
+		LogEnabled: conf.LogEnabled,
+	}
+	adminServer := &http.Server{
+		Addr:    conf.Addr,
+		Handler: chainMiddleware(newAdminHandler(p), newRouteMiddlewares("admin", options, nil, nil)...),
+	}
+	go func() {
+		log.Printf("Admin API listening on %s", conf.Addr)
+		err := adminServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start admin server: %v", err)
+		}
+	}()
+	return adminServer
+}
@@ -0,0 +1,151 @@
+// audit.go 文件实现了审计日志。
+// 每一次转发到后端的工具调用、资源读取和提示获取都会以一行 JSON 追加到审计日志文件中，
+// 文件按大小轮转；调用方只记录令牌的哈希值，参数可以按名称脱敏。
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// redacted 是脱敏后的参数值
+const redacted = "[REDACTED]"
+
+// AuditRecord 是审计日志中的一条记录
+type AuditRecord struct {
+	Timestamp  time.Time `json:"timestamp"`           // 调用开始的时间
+	Backend    string    `json:"backend"`             // 处理调用的后端名称
+	Method     string    `json:"method"`              // MCP 方法名，例如 tools/call
+	Name       string    `json:"name,omitempty"`      // 工具或提示的名称
+	URI        string    `json:"uri,omitempty"`       // 读取的资源 URI
+	Identity   *Identity `json:"identity,omitempty"`  // 调用方身份，未认证时为空
+	Session    string    `json:"session,omitempty"`   // 下游会话 ID
+	Arguments  any       `json:"arguments,omitempty"` // 调用参数，已按配置脱敏
+	ResultSize int       `json:"resultSize"`          // 结果序列化为 JSON 后的字节数
+	IsError    bool      `json:"isError,omitempty"`   // 工具是否返回了执行错误
+	Error      string    `json:"error,omitempty"`     // 转发失败的原因
+	DurationMs float64   `json:"durationMs"`          // 调用耗时（毫秒）
+}
+
+// auditLogger 负责写入审计日志，nil 表示未启用审计
+type auditLogger struct {
+	writesOnly bool
+	redactAll  bool
+	redact     map[string]struct{}
+
+	mu  sync.Mutex
+	out *lumberjack.Logger
+}
+
+// newAuditLogger 根据配置创建审计日志，未配置时返回 nil
+func newAuditLogger(conf *AuditConfig) *auditLogger {
+	if conf == nil {
+		return nil
+	}
+	a := &auditLogger{
+		writesOnly: conf.WritesOnly,
+		redact:     make(map[string]struct{}, len(conf.Redact)),
+		out: &lumberjack.Logger{
+			Filename:   conf.File,
+			MaxSize:    conf.MaxSize,
+			MaxBackups: conf.MaxBackups,
+			MaxAge:     conf.MaxAge,
+			Compress:   conf.Compress,
+		},
+	}
+	for _, key := range conf.Redact {
+		if key == "*" {
+			a.redactAll = true
+		}
+		a.redact[strings.ToLower(key)] = struct{}{}
+	}
+	return a
+}
+
+// enabled 判断是否需要记录某次调用，readOnly 表示调用不会产生副作用
+func (a *auditLogger) enabled(readOnly bool) bool {
+	return a != nil && !(a.writesOnly && readOnly)
+}
+
+// write 补全记录中来自上下文的字段，并把它追加到审计日志
+func (a *auditLogger) write(ctx context.Context, record AuditRecord, result any, err error) {
+	record.DurationMs = float64(time.Since(record.Timestamp).Microseconds()) / 1000
+	record.Identity = identityFromContext(ctx)
+	if session := server.ClientSessionFromContext(ctx); session != nil {
+		record.Session = session.SessionID()
+	}
+	record.Arguments = a.redactValue(record.Arguments)
+	if err != nil {
+		record.Error = err.Error()
+	} else if result != nil {
+		if data, marshalErr := json.Marshal(result); marshalErr == nil {
+			record.ResultSize = len(data)
+		}
+	}
+
+	line, marshalErr := json.Marshal(record)
+	if marshalErr != nil {
+		log.Printf("<%s> Failed to encode audit record: %v", record.Backend, marshalErr)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, writeErr := a.out.Write(append(line, '\n')); writeErr != nil {
+		log.Printf("<%s> Failed to write audit record: %v", record.Backend, writeErr)
+	}
+}
+
+// redactValue 递归地替换需要脱敏的参数
+func (a *auditLogger) redactValue(value any) any {
+	if a.redactAll && value != nil {
+		return redacted
+	}
+	switch v := value.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for key, item := range v {
+			if _, ok := a.redact[strings.ToLower(key)]; ok {
+				out[key] = redacted
+				continue
+			}
+			out[key] = a.redactValue(item)
+		}
+		return out
+	case map[string]string:
+		out := make(map[string]any, len(v))
+		for key, item := range v {
+			out[key] = item
+		}
+		return a.redactValue(out)
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = a.redactValue(item)
+		}
+		return out
+	}
+	return value
+}
+
+// Close 关闭审计日志文件
+func (a *auditLogger) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.out.Close()
+}
+
+// isReadOnlyTool 判断工具是否声明了只读
+func isReadOnlyTool(tool mcp.Tool) bool {
+	return tool.Annotations.ReadOnlyHint != nil && *tool.Annotations.ReadOnlyHint
+}
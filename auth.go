@@ -0,0 +1,140 @@
+// auth.go 文件定义了调用方身份和授权作用域。
+// 认证中间件会把调用方身份放入请求的上下文中，转发调用时据此检查调用方能否使用目标服务器和工具，
+// 列出工具时也会过滤掉调用方无权使用的工具。
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Identity 描述了通过认证的调用方，会被放入请求的上下文中，供授权、日志和审计使用
+type Identity struct {
+	TokenHash string  `json:"tokenHash,omitempty"` // 令牌的哈希值，不会记录令牌本身
+	Principal string  `json:"principal,omitempty"` // 具名调用方的名称，不受限制的令牌为空
+	Subject   string  `json:"subject,omitempty"`   // JWT 的 sub 声明，只有使用 JWT 认证时才有
+	scopes    []scope // 授权作用域，为 nil 时不受限制
+
+	oauthScopes []string // 访问令牌具有的 OAuth scope，只有使用 JWT 或令牌内省认证时才有
+}
+
+// caller 返回用于日志和错误信息的调用方名称，依次使用具名调用方、JWT 主体和令牌哈希
+func (i *Identity) caller() string {
+	switch {
+	case i == nil:
+		return "anonymous"
+	case i.Principal != "":
+		return i.Principal
+	case i.Subject != "":
+		return i.Subject
+	}
+	return "token:" + i.TokenHash
+}
+
+// scope 是一条授权作用域，服务器和工具名称都支持 path.Match 风格的通配符
+type scope struct {
+	server string
+	tool   string
+}
+
+// parseScope 解析一条形如 "server:tool" 的作用域，省略工具部分时表示该服务器上的所有工具，"*" 表示所有服务器
+func parseScope(value string) scope {
+	server, tool, found := strings.Cut(value, ":")
+	if !found {
+		tool = "*"
+	}
+	return scope{server: server, tool: tool}
+}
+
+// parseScopes 解析作用域列表，调用方已经通过 validateScope 校验过格式
+func parseScopes(values []string) []scope {
+	scopes := make([]scope, 0, len(values))
+	for _, value := range values {
+		scopes = append(scopes, parseScope(value))
+	}
+	return scopes
+}
+
+// validateScope 检查作用域中的通配符格式是否正确
+func validateScope(value string) error {
+	s := parseScope(value)
+	if s.server == "" || s.tool == "" {
+		return fmt.Errorf("invalid scope %q", value)
+	}
+	for _, pattern := range []string{s.server, s.tool} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid scope %q: %w", value, err)
+		}
+	}
+	return nil
+}
+
+// allowsServer 判断调用方能否访问给定服务器上的至少一部分能力
+func (i *Identity) allowsServer(server string) bool {
+	if i == nil || i.scopes == nil {
+		return true
+	}
+	for _, s := range i.scopes {
+		if ok, _ := path.Match(s.server, server); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsTool 判断调用方能否调用给定服务器上的工具，工具名称为后端的原始名称
+func (i *Identity) allowsTool(server, tool string) bool {
+	if i == nil || i.scopes == nil {
+		return true
+	}
+	for _, s := range i.scopes {
+		serverOK, _ := path.Match(s.server, server)
+		toolOK, _ := path.Match(s.tool, tool)
+		if serverOK && toolOK {
+			return true
+		}
+	}
+	return false
+}
+
+// identityKey 是 Identity 在上下文中的键
+type identityKey struct{}
+
+// withIdentity 返回携带调用方身份的上下文
+func withIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// identityFromContext 返回上下文中的调用方身份，未认证的请求返回 nil
+func identityFromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// hashToken 返回令牌的 SHA-256 哈希值的前 16 位十六进制字符，用于在日志中区分调用方
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// authorizeTool 检查上下文中的调用方能否调用给定服务器上的工具
+func authorizeTool(ctx context.Context, server, tool string) error {
+	identity := identityFromContext(ctx)
+	if identity.allowsTool(server, tool) {
+		return nil
+	}
+	return fmt.Errorf("caller %s is not allowed to call tool %s on %s", identity.caller(), tool, server)
+}
+
+// authorizeServer 检查上下文中的调用方能否访问给定服务器
+func authorizeServer(ctx context.Context, server string) error {
+	identity := identityFromContext(ctx)
+	if identity.allowsServer(server) {
+		return nil
+	}
+	return fmt.Errorf("caller %s is not allowed to access %s", identity.caller(), server)
+}
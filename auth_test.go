@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseScope(t *testing.T) {
+	tests := []struct {
+		value string
+		want  scope
+	}{
+		{"github:list_*", scope{server: "github", tool: "list_*"}},
+		{"fetch", scope{server: "fetch", tool: "*"}},
+		{"*", scope{server: "*", tool: "*"}},
+		{"a/b:c", scope{server: "a/b", tool: "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := parseScope(tt.value); got != tt.want {
+				t.Errorf("parseScope(%q) = %+v, want %+v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateScope(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"github:list_*", false},
+		{"fetch", false},
+		{"*", false},
+		{"git?ub:[a-z]*", false},
+		{"", true},
+		{":tool", true},
+		{"github:", true},
+		{"github:[", true},
+		{"[:tool", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if err := validateScope(tt.value); (err != nil) != tt.wantErr {
+				t.Errorf("validateScope(%q) = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIdentityAllows(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity *Identity
+		server   string
+		tool     string
+		wantSrv  bool
+		wantTool bool
+	}{
+		{"anonymous", nil, "github", "x", true, true},
+		{"unrestricted token", &Identity{}, "github", "x", true, true},
+		{"no scopes", &Identity{scopes: parseScopes(nil)}, "github", "x", false, false},
+		{"exact tool", &Identity{scopes: parseScopes([]string{"github:list_issues"})}, "github", "list_issues", true, true},
+		{"tool wildcard", &Identity{scopes: parseScopes([]string{"github:list_*"})}, "github", "create_issue", true, false},
+		{"server only", &Identity{scopes: parseScopes([]string{"fetch"})}, "fetch", "anything", true, true},
+		{"other server", &Identity{scopes: parseScopes([]string{"fetch"})}, "github", "list_issues", false, false},
+		{"server wildcard", &Identity{scopes: parseScopes([]string{"git*:list_*"})}, "gitlab", "list_mrs", true, true},
+		{"single character wildcard", &Identity{scopes: parseScopes([]string{"s?:*"})}, "s1", "x", true, true},
+		{"wildcard does not cross slash", &Identity{scopes: parseScopes([]string{"team*"})}, "team/a", "x", false, false},
+		{"everything", &Identity{scopes: parseScopes([]string{"*"})}, "fetch", "fetch", true, true},
+		{"union of scopes", &Identity{scopes: parseScopes([]string{"fetch", "github:get_*"})}, "github", "get_issue", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.identity.allowsServer(tt.server); got != tt.wantSrv {
+				t.Errorf("allowsServer(%q) = %v, want %v", tt.server, got, tt.wantSrv)
+			}
+			if got := tt.identity.allowsTool(tt.server, tt.tool); got != tt.wantTool {
+				t.Errorf("allowsTool(%q, %q) = %v, want %v", tt.server, tt.tool, got, tt.wantTool)
+			}
+		})
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	principals := map[string]*PrincipalConfig{
+		"ci": {Tokens: []string{"ci-token"}, Scopes: []string{"github:list_*"}},
+	}
+	handler := newAuthMiddleware([]string{"admin-token"}, principals, nil, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := identityFromContext(r.Context())
+		w.Header().Set("X-Caller", identity.caller())
+	}))
+	tests := []struct {
+		name       string
+		header     string
+		wantStatus int
+		wantCaller string
+	}{
+		{"missing token", "", http.StatusUnauthorized, ""},
+		{"unknown token", "Bearer nope", http.StatusUnauthorized, ""},
+		{"static token", "Bearer admin-token", http.StatusOK, "token:" + hashToken("admin-token")},
+		{"principal token", "Bearer ci-token", http.StatusOK, "ci"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/github/mcp", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("X-Caller"); got != tt.wantCaller {
+				t.Errorf("caller = %q, want %q", got, tt.wantCaller)
+			}
+		})
+	}
+}
@@ -8,26 +8,78 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"maps"
+	"net/http"
+	"os/exec"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mark3labs/mcp-go/client"
 	"github.com/mark3labs/mcp-go/client/transport"
 	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Client 是对 MCP 客户端的封装，添加了一些代理相关的元数据和方法
+// 底层客户端在断开后会被监督任务重新创建，因此所有对它的访问都需要经过 mu 保护
 type Client struct {
-	name            string         // 客户端名称，用于日志和路由
-	needPing        bool           // 是否需要定期发送 ping 请求
-	needManualStart bool           // 是否需要手动启动客户端（对于 SSE 和 HTTP 客户端）
-	client          *client.Client // 底层 MCP 客户端实例
-	options         *Options       // 客户端选项
+	name        string             // 客户端名称，用于日志和路由
+	config      any                // 解析后的具体客户端配置，用于在重连时重新创建底层客户端
+	clientInfo  mcp.Implementation // 初始化后端时使用的客户端信息
+	lost        chan error         // 底层连接断开时的通知通道
+	ctx         context.Context    // 监督任务的父上下文，手动重启时使用
+	audit       *auditLogger       // 审计日志，未启用时为 nil
+	auth        *upstreamAuth      // 访问后端时的 OAuth 认证，重连时复用缓存的令牌，未配置时为 nil
+	forward     *headerForwarder   // 转发给后端的调用方凭据，未配置时为 nil
+	sessions    *sessionPool       // 按下游会话建立的后端连接，只在转发调用方凭据或按会话隔离时使用
+	lazy        *lazyStart         // stdio 后端的按需启动，未启用时为 nil
+	stderr      *stderrLog         // stdio 子进程的标准错误输出，其他类型为 nil
+	killTimeout time.Duration      // 关闭 stdio 子进程时等待其退出的时间，超时后强制结束
+
+	mu          sync.RWMutex
+	cancel      context.CancelFunc     // 停止监督任务
+	supervised  chan struct{}          // 监督任务退出时关闭
+	options     *Options               // 客户端选项，重新加载配置时会被替换
+	client      *client.Client         // 底层 MCP 客户端实例
+	cmd         *exec.Cmd              // stdio 类型客户端的子进程，其他类型为 nil
+	state       ClientState            // 当前连接状态
+	lastErr     error                  // 最近一次连接失败或断开的原因
+	connectedAt time.Time              // 最近一次成功连接的时间
+	nextRetry   time.Time              // 下一次重连的时间
+	restarts    int                    // 累计重连次数
+	catalog     *catalog               // 最近一次从后端获取到的能力列表
+	registries  []*registry            // 需要同步能力变化的注册表，例如路由自身和聚合路由
+	draining    bool                   // 是否正在排空，排空期间拒绝新的调用
+	inflight    sync.WaitGroup         // 进行中的转发调用
+	callers     []server.ClientSession // 在共享连接上进行中的调用所属的下游会话，用于转发后端发往客户端的请求
+
+	resyncing     bool                            // 是否正在因后端的通知重新获取能力列表
+	resyncPending bool                            // 重新获取期间是否又收到了能力列表变化的通知
+	subscribers   map[string][]subscriber         // 资源 URI -> 订阅了该资源的下游会话
+	progress      map[string]progressTarget       // 转发给后端的进度令牌 -> 接收进度通知的下游请求
+	progressSeq   uint64                          // 最近一次分配的进度令牌序号
+	logLevels     map[subscriber]mcp.LoggingLevel // 设置过日志级别的下游会话 -> 级别
+	logLevel      mcp.LoggingLevel                // 共享连接上当前设置的日志级别，未设置时为空
+
+	subMu sync.Mutex // 保证同一时间只有一次订阅变化在进行，持有期间可能等待后端的响应
+	logMu sync.Mutex // 保证同一时间只有一次日志级别变化在进行，持有期间可能等待后端的响应
+}
+
+// catalog 保存从后端获取到的能力列表，工具列表已经应用了工具过滤
+type catalog struct {
+	tools             []mcp.Tool
+	prompts           []mcp.Prompt
+	resources         []mcp.Resource
+	resourceTemplates []mcp.ResourceTemplate
+	logging           bool // 后端是否声明了日志能力
 }
 
 // newMCPClient 创建一个新的 MCP 客户端实例
-// 根据配置，它会创建合适类型的客户端（stdio、sse 或 streamable-http）
+// 它只负责解析和校验配置，真正的连接在 addToMCPServer 中建立
 func newMCPClient(name string, conf *MCPClientConfig) (*Client, error) {
 	// 解析客户端配置，确定具体的客户端类型
 	clientInfo, pErr := parseMCPClientConfig(conf)
@@ -35,8 +87,54 @@ func newMCPClient(name string, conf *MCPClientConfig) (*Client, error) {
 		return nil, pErr
 	}
 
-	// 根据具体的客户端类型创建对应的客户端实例
+	c := &Client{
+		name:        name,
+		config:      clientInfo,
+		lost:        make(chan error, 1),
+		options:     conf.Options,
+		state:       ClientStateConnecting,
+		killTimeout: stopTimeout,
+	}
 	switch v := clientInfo.(type) {
+	case *StdioMCPClientConfig:
+		// Stdio 客户端在创建时就会启动子进程（按需启动时在第一次调用时启动），按会话隔离时每个下游会话还会启动独立的子进程
+		c.lazy = newLazyStart(v)
+		if v.KillTimeout > 0 {
+			c.killTimeout = v.KillTimeout
+		}
+		if v.Stderr != nil {
+			c.stderr = newStderrLog(name, v.Stderr)
+		}
+		if v.Isolation == IsolationSession {
+			c.sessions = newSessionPool(name, v.IdleTimeout, v.MaxProcesses, c.killTimeout)
+			c.sessions.shared = c.sharedRunning
+		}
+	case *SSEMCPClientConfig:
+		c.auth = newUpstreamAuth(name, v.Auth)
+		c.setForward(v.Forward)
+	case *StreamableMCPClientConfig:
+		c.auth = newUpstreamAuth(name, v.Auth)
+		c.setForward(v.Forward)
+	default:
+		return nil, errors.New("invalid client type")
+	}
+	return c, nil
+}
+
+// setForward 启用调用方凭据转发，之后每个下游会话都会使用独立的后端连接
+func (c *Client) setForward(conf *ForwardConfig) {
+	if conf == nil {
+		return
+	}
+	c.forward = newHeaderForwarder(conf)
+	c.sessions = newSessionPool(c.name, time.Duration(conf.IdleTimeout), 0, c.killTimeout)
+}
+
+// dial 根据配置创建一个新的底层 MCP 客户端（stdio、sse 或 streamable-http）
+// 对于 stdio 类型，还会返回启动的子进程，以便在断开后检查它的退出状态
+// headers 是会话连接额外携带的请求头，会覆盖配置中的同名请求头；session 是会话连接所属的下游会话，共享的连接为 nil
+func (c *Client) dial(ctx context.Context, headers map[string]string, session server.ClientSession) (*client.Client, *exec.Cmd, error) {
+	switch v := c.config.(type) {
 	case *StdioMCPClientConfig:
 		// 处理 Stdio 类型的客户端
 		// 将环境变量映射转换为字符串切片格式
@@ -44,142 +142,289 @@ func newMCPClient(name string, conf *MCPClientConfig) (*Client, error) {
 		for kk, vv := range v.Env {
 			envs = append(envs, fmt.Sprintf("%s=%s", kk, vv))
 		}
-		// 创建 Stdio MCP 客户端
-		mcpClient, err := client.NewStdioMCPClient(v.Command, envs, v.Args...)
-		if err != nil {
-			return nil, err
+		// 创建并启动 Stdio 传输层，并记录启动的子进程
+		var cmd *exec.Cmd
+		stdio := transport.NewStdioWithOptions(v.Command, envs, v.Args,
+			transport.WithCommandFunc(func(ctx context.Context, command string, env []string, args []string) (*exec.Cmd, error) {
+				var err error
+				cmd, err = newStdioCommand(ctx, v, command, env, args)
+				return cmd, err
+			}),
+		)
+		// 调用方已经放弃（例如连接超时）时不再启动子进程
+		if err := ctx.Err(); err != nil {
+			return nil, nil, fmt.Errorf("failed to start stdio transport: %w", err)
 		}
-
-		// 返回封装后的客户端
-		return &Client{
-			name:    name,
-			client:  mcpClient,
-			options: conf.Options,
-		}, nil
+		// 传输层用这个上下文创建子进程，子进程的生命周期跟随底层客户端，由 closeMCPClient 结束，
+		// 因此只保留调用方上下文中的值（例如链路追踪），不继承它的取消和超时
+		if err := stdio.Start(context.WithoutCancel(ctx)); err != nil {
+			return nil, nil, fmt.Errorf("failed to start stdio transport: %w", err)
+		}
+		// 子进程已经启动，持续读取它的标准错误输出
+		if c.stderr != nil {
+			go c.stderr.capture(stdio.Stderr())
+		}
+		// 创建 Stdio MCP 客户端，后端发往客户端的请求会被转发给下游会话
+		return client.NewClient(&cancellingTransport{Interface: stdio, name: c.name}, c.clientOptions(session)...), cmd, nil
 	case *SSEMCPClientConfig:
 		// 处理 SSE 类型的客户端
-		var options []transport.ClientOption
-		if len(v.Headers) > 0 {
-			options = append(options, client.WithHeaders(v.Headers))
+		// 转发请求时携带链路追踪的上下文
+		options := []transport.ClientOption{transport.WithHeaderFunc(traceHeaders)}
+		if headers = mergeHeaders(v.Headers, headers); len(headers) > 0 {
+			options = append(options, client.WithHeaders(headers))
+		}
+		if c.auth != nil {
+			options = append(options, transport.WithHTTPClient(c.auth.httpClient()))
 		}
-		// 创建 SSE MCP 客户端
-		mcpClient, err := client.NewSSEMCPClient(v.URL, options...)
+		// 创建 SSE MCP 客户端，SSE 传输层不支持后端发往客户端的请求
+		sse, err := transport.NewSSE(v.URL, options...)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		// 返回封装后的客户端，注意 SSE 客户端需要手动启动和定期 ping
-		return &Client{
-			name:            name,
-			needPing:        true,
-			needManualStart: true,
-			client:          mcpClient,
-			options:         conf.Options,
-		}, nil
+		return client.NewClient(&cancellingTransport{Interface: sse, name: c.name}), nil, nil
 	case *StreamableMCPClientConfig:
 		// 处理 Streamable HTTP 类型的客户端
-		var options []transport.StreamableHTTPCOption
-		if len(v.Headers) > 0 {
-			options = append(options, transport.WithHTTPHeaders(v.Headers))
+		// 转发请求时携带链路追踪的上下文
+		options := []transport.StreamableHTTPCOption{transport.WithHTTPHeaderFunc(traceHeaders)}
+		if headers = mergeHeaders(v.Headers, headers); len(headers) > 0 {
+			options = append(options, transport.WithHTTPHeaders(headers))
+		}
+		// 自定义的 HTTP 客户端需要在设置超时之前传入，否则超时会被设置到默认客户端上
+		if c.auth != nil {
+			options = append(options, transport.WithHTTPBasicClient(c.auth.httpClient()))
 		}
 		if v.Timeout > 0 {
 			options = append(options, transport.WithHTTPTimeout(v.Timeout))
 		}
-		// 创建 Streamable HTTP MCP 客户端
-		mcpClient, err := client.NewStreamableHttpClient(v.URL, options...)
+		// 创建 Streamable HTTP MCP 客户端，后端发往客户端的请求会被转发给下游会话
+		streamable, err := transport.NewStreamableHTTP(v.URL, options...)
 		if err != nil {
-			return nil, err
-		}
-		// 返回封装后的客户端，注意 HTTP 客户端也需要手动启动和定期 ping
-		return &Client{
-			name:            name,
-			needPing:        true,
-			needManualStart: true,
-			client:          mcpClient,
-			options:         conf.Options,
-		}, nil
-	}
-	return nil, errors.New("invalid client type")
-}
-
-// addToMCPServer 是代理核心功能的实现
-// 它连接到后端 MCP 服务，获取其能力（工具、提示、资源等），
-// 并将这些能力注册到代理的 MCP 服务器实例上
-func (c *Client) addToMCPServer(ctx context.Context, clientInfo mcp.Implementation, mcpServer *server.MCPServer) error {
-	// 如果需要手动启动客户端（对于 SSE 和 HTTP 客户端），先启动它
-	if c.needManualStart {
-		err := c.client.Start(ctx)
-		if err != nil {
-			return err
+			return nil, nil, err
 		}
+		return client.NewClient(&cancellingTransport{Interface: streamable, name: c.name}, c.clientOptions(session)...), nil, nil
+	}
+	return nil, nil, errors.New("invalid client type")
+}
+
+// mergeHeaders 合并配置中的请求头和会话连接额外携带的请求头
+func mergeHeaders(base, extra map[string]string) map[string]string {
+	if len(extra) == 0 {
+		return base
+	}
+	merged := maps.Clone(base)
+	if merged == nil {
+		merged = make(map[string]string, len(extra))
+	}
+	maps.Copy(merged, extra)
+	return merged
+}
+
+// initialize 启动底层客户端并完成 MCP 初始化握手，失败时关闭客户端
+func (c *Client) initialize(ctx context.Context, mcpClient *client.Client, cmd *exec.Cmd) error {
+	// 启动客户端（对于 SSE 和 HTTP 客户端）并注册通知处理函数
+	// stdio 客户端的传输层在创建时已经启动，这里不会重复启动子进程，但仍然需要调用以接收后端的通知
+	if err := mcpClient.Start(ctx); err != nil {
+		_ = closeMCPClient(mcpClient, cmd, c.killTimeout)
+		return err
 	}
 
 	// 准备 MCP 初始化请求
 	initRequest := mcp.InitializeRequest{}
 	initRequest.Params.ProtocolVersion = mcp.LATEST_PROTOCOL_VERSION
-	initRequest.Params.ClientInfo = clientInfo
+	initRequest.Params.ClientInfo = c.clientInfo
+	// sampling、roots 和 elicitation 能力由 dial 时注册的转发处理函数声明
 	initRequest.Params.Capabilities = mcp.ClientCapabilities{
 		Experimental: make(map[string]interface{}),
-		Roots:        nil,
-		Sampling:     nil,
 	}
 
 	// 向后端 MCP 服务发送初始化请求
-	_, err := c.client.Initialize(ctx, initRequest)
+	if _, err := mcpClient.Initialize(ctx, initRequest); err != nil {
+		_ = closeMCPClient(mcpClient, cmd, c.killTimeout)
+		return err
+	}
+	return nil
+}
+
+// connect 是代理核心功能的实现
+// 它创建并初始化一个新的底层客户端，获取后端的能力（工具、提示、资源等），
+// 然后替换当前的底层客户端，并把能力同步到所有已关联的注册表
+func (c *Client) connect(ctx context.Context) error {
+	mcpClient, cmd, err := c.dial(ctx, nil, nil)
 	if err != nil {
 		return err
 	}
+	if err = c.initialize(ctx, mcpClient, cmd); err != nil {
+		return err
+	}
 	log.Printf("<%s> Successfully initialized MCP client", c.name)
 
-	// 获取后端服务提供的各种能力，并添加到代理的 MCP 服务器
-	// 首先添加工具，这是必须成功的
-	err = c.addToolsToServer(ctx, mcpServer)
+	// 获取后端服务提供的各种能力
+	newCatalog, err := c.fetchCatalog(ctx, mcpClient)
 	if err != nil {
+		_ = closeMCPClient(mcpClient, cmd, c.killTimeout)
 		return err
 	}
 
-	// 尝试添加提示、资源和资源模板，即使这些操作失败也不会影响整体功能
-	_ = c.addPromptsToServer(ctx, mcpServer)
-	_ = c.addResourcesToServer(ctx, mcpServer)
-	_ = c.addResourceTemplatesToServer(ctx, mcpServer)
+	// 连接断开时通知监督任务
+	mcpClient.OnConnectionLost(func(err error) {
+		c.connectionLost(mcpClient, err)
+	})
+	// 后端的能力列表变化时重新获取并同步到下游，并转发进度等通知
+	mcpClient.OnNotification(func(notification mcp.JSONRPCNotification) {
+		c.handleNotification(mcpClient, notification)
+	})
+
+	// 替换底层客户端和能力列表，并丢弃替换前残留的断开通知
+	c.mu.Lock()
+	select {
+	case <-c.lost:
+	default:
+	}
+	c.client = mcpClient
+	c.cmd = cmd
+	c.catalog = newCatalog
+	c.logLevel = ""
+	c.state = ClientStateReady
+	c.lastErr = nil
+	c.connectedAt = time.Now()
+	c.nextRetry = time.Time{}
+	c.mu.Unlock()
+
+	// 按需启动的后端缓存能力列表，下一次启动代理时无需先启动进程
+	if c.lazy != nil {
+		if err = c.lazy.save(newCatalog); err != nil {
+			log.Printf("<%s> Failed to cache catalog: %v", c.name, err)
+		}
+	}
 
-	// 如果需要定期 ping，启动 ping 任务
-	if c.needPing {
-		go c.startPingTask(ctx)
+	// 将新的能力列表同步到所有注册表，已连接的下游会话无需重新连接
+	c.syncRegistries()
+	// 重新订阅下游会话订阅的资源
+	if c.hasSubscriptions() {
+		go c.resubscribe(mcpClient)
 	}
+	// 恢复下游会话设置的日志级别
+	go c.restoreLogLevel(mcpClient)
 	return nil
 }
 
-// startPingTask 启动一个定期 ping 后端服务的任务
-// 每 30 秒发送一次 ping 请求，确保连接保持活跃
-func (c *Client) startPingTask(ctx context.Context) {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-PingLoop:
-	for {
-		select {
-		case <-ctx.Done():
-			log.Printf("<%s> Context done, stopping ping", c.name)
-			break PingLoop
-		case <-ticker.C:
-			_ = c.client.Ping(ctx)
+// connectionLost 通知监督任务底层客户端已断开，只有当前仍在使用的底层客户端才会触发重连
+func (c *Client) connectionLost(mcpClient *client.Client, err error) {
+	c.mu.RLock()
+	current := c.client == mcpClient
+	c.mu.RUnlock()
+	if !current {
+		return
+	}
+	select {
+	case c.lost <- err:
+	default:
+	}
+}
+
+// refresh 使用当前的底层客户端重新获取能力列表，并同步到所有注册表
+// 用于在工具过滤等选项变化后更新已注册的能力，按需启动的后端没有运行时会先启动它
+func (c *Client) refresh(ctx context.Context) error {
+	mcpClient, release, err := c.sharedClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	newCatalog, err := c.fetchCatalog(ctx, mcpClient)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.catalog = newCatalog
+	c.mu.Unlock()
+	c.syncRegistries()
+	return nil
+}
+
+// syncRegistries 将当前的能力列表同步到所有已关联的注册表
+func (c *Client) syncRegistries() {
+	c.mu.RLock()
+	registries := slices.Clone(c.registries)
+	c.mu.RUnlock()
+	for _, reg := range registries {
+		if syncErr := reg.syncClient(c); syncErr != nil {
+			log.Printf("<%s> Name collisions while syncing %s: %v", reg.name, c.name, syncErr)
 		}
 	}
 }
 
-// addToolsToServer 从后端服务获取可用的工具列表，并将它们添加到代理的 MCP 服务器
-// 同时应用工具过滤逻辑，决定哪些工具可以被添加
-func (c *Client) addToolsToServer(ctx context.Context, mcpServer *server.MCPServer) error {
-	toolsRequest := mcp.ListToolsRequest{}
+// fetchCatalog 获取后端服务提供的工具、提示、资源和资源模板
+// 工具列表必须获取成功，其余能力获取失败时视为空列表，不影响整体功能
+func (c *Client) fetchCatalog(ctx context.Context, mcpClient *client.Client) (*catalog, error) {
+	tools, err := c.listTools(ctx, mcpClient)
+	if err != nil {
+		return nil, err
+	}
+	prompts, _ := c.listPrompts(ctx, mcpClient)
+	resources, _ := c.listResources(ctx, mcpClient)
+	resourceTemplates, _ := c.listResourceTemplates(ctx, mcpClient)
+	return &catalog{
+		tools:             tools,
+		prompts:           prompts,
+		resources:         resources,
+		resourceTemplates: resourceTemplates,
+		logging:           mcpClient.GetServerCapabilities().Logging != nil,
+	}, nil
+}
+
+// snapshot 返回当前的能力列表，客户端尚未连接成功时返回空列表
+func (c *Client) snapshot() *catalog {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.catalog == nil {
+		return &catalog{}
+	}
+	return c.catalog
+}
+
+// attach 关联一个注册表，之后每次重新获取能力列表时都会同步到该注册表
+func (c *Client) attach(reg *registry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.registries = append(c.registries, reg)
+}
+
+// detach 取消与注册表的关联
+func (c *Client) detach(reg *registry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.registries = slices.DeleteFunc(c.registries, func(r *registry) bool {
+		return r == reg
+	})
+}
+
+// currentOptions 返回客户端当前的选项
+func (c *Client) currentOptions() *Options {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.options
+}
+
+// setOptions 替换客户端的选项，新的选项会在下一次获取能力列表或重连时生效
+func (c *Client) setOptions(options *Options) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.options = options
+}
+
+// toolFilter 根据工具过滤配置构建过滤函数，未配置时允许所有工具
+func (c *Client) toolFilter() func(toolName string) bool {
 	// 默认的过滤函数允许所有工具
 	filterFunc := func(toolName string) bool {
 		return true
 	}
 
 	// 如果配置了工具过滤器，根据过滤模式构建过滤函数
-	if c.options != nil && c.options.ToolFilter != nil && len(c.options.ToolFilter.List) > 0 {
+	options := c.currentOptions()
+	if options != nil && options.ToolFilter != nil && len(options.ToolFilter.List) > 0 {
 		filterSet := make(map[string]struct{})
-		mode := ToolFilterMode(strings.ToLower(string(c.options.ToolFilter.Mode)))
-		for _, toolName := range c.options.ToolFilter.List {
+		mode := ToolFilterMode(strings.ToLower(string(options.ToolFilter.Mode)))
+		for _, toolName := range options.ToolFilter.List {
 			filterSet[toolName] = struct{}{}
 		}
 
@@ -207,25 +452,30 @@ func (c *Client) addToolsToServer(ctx context.Context, mcpServer *server.MCPServ
 			log.Printf("<%s> Unknown tool filter mode: %s, skipping tool filter", c.name, mode)
 		}
 	}
+	return filterFunc
+}
+
+// listTools 从后端服务获取可用的工具列表，并应用工具过滤逻辑，决定哪些工具可以被代理
+func (c *Client) listTools(ctx context.Context, mcpClient *client.Client) ([]mcp.Tool, error) {
+	toolsRequest := mcp.ListToolsRequest{}
+	filterFunc := c.toolFilter()
 
+	var result []mcp.Tool
 	// 支持分页获取工具列表
 	for {
-		tools, err := c.client.ListTools(ctx, toolsRequest)
+		tools, err := mcpClient.ListTools(ctx, toolsRequest)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if len(tools.Tools) == 0 {
 			break
 		}
 		log.Printf("<%s> Successfully listed %d tools", c.name, len(tools.Tools))
 
-		// 遍历每个工具，应用过滤函数，并将符合条件的工具添加到代理服务器
+		// 遍历每个工具，应用过滤函数，保留符合条件的工具
 		for _, tool := range tools.Tools {
 			if filterFunc(tool.Name) {
-				log.Printf("<%s> Adding tool %s", c.name, tool.Name)
-				// 注意：这里的第二个参数是一个回调函数，当代理收到工具调用请求时，
-				// 它会调用这个函数，从而将请求转发到真正的后端服务
-				mcpServer.AddTool(tool, c.client.CallTool)
+				result = append(result, tool)
 			}
 		}
 
@@ -236,28 +486,24 @@ func (c *Client) addToolsToServer(ctx context.Context, mcpServer *server.MCPServ
 		toolsRequest.Params.Cursor = tools.NextCursor
 	}
 
-	return nil
+	return result, nil
 }
 
-// addPromptsToServer 从后端服务获取可用的提示列表，并将它们添加到代理的 MCP 服务器
-func (c *Client) addPromptsToServer(ctx context.Context, mcpServer *server.MCPServer) error {
+// listPrompts 从后端服务获取可用的提示列表
+func (c *Client) listPrompts(ctx context.Context, mcpClient *client.Client) ([]mcp.Prompt, error) {
 	promptsRequest := mcp.ListPromptsRequest{}
+	var result []mcp.Prompt
 	// 支持分页获取提示列表
 	for {
-		prompts, err := c.client.ListPrompts(ctx, promptsRequest)
+		prompts, err := mcpClient.ListPrompts(ctx, promptsRequest)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if len(prompts.Prompts) == 0 {
 			break
 		}
 		log.Printf("<%s> Successfully listed %d prompts", c.name, len(prompts.Prompts))
-
-		// 遍历每个提示，并将其添加到代理服务器
-		for _, prompt := range prompts.Prompts {
-			log.Printf("<%s> Adding prompt %s", c.name, prompt.Name)
-			mcpServer.AddPrompt(prompt, c.client.GetPrompt)
-		}
+		result = append(result, prompts.Prompts...)
 
 		// 检查是否有更多页面
 		if prompts.NextCursor == "" {
@@ -265,35 +511,24 @@ func (c *Client) addPromptsToServer(ctx context.Context, mcpServer *server.MCPSe
 		}
 		promptsRequest.Params.Cursor = prompts.NextCursor
 	}
-	return nil
+	return result, nil
 }
 
-// addResourcesToServer 从后端服务获取可用的资源列表，并将它们添加到代理的 MCP 服务器
-func (c *Client) addResourcesToServer(ctx context.Context, mcpServer *server.MCPServer) error {
+// listResources 从后端服务获取可用的资源列表
+func (c *Client) listResources(ctx context.Context, mcpClient *client.Client) ([]mcp.Resource, error) {
 	resourcesRequest := mcp.ListResourcesRequest{}
+	var result []mcp.Resource
 	// 支持分页获取资源列表
 	for {
-		resources, err := c.client.ListResources(ctx, resourcesRequest)
+		resources, err := mcpClient.ListResources(ctx, resourcesRequest)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if len(resources.Resources) == 0 {
 			break
 		}
 		log.Printf("<%s> Successfully listed %d resources", c.name, len(resources.Resources))
-
-		// 遍历每个资源，并将其添加到代理服务器
-		for _, resource := range resources.Resources {
-			log.Printf("<%s> Adding resource %s", c.name, resource.Name)
-			// 为每个资源创建一个读取函数，用于处理读取请求
-			mcpServer.AddResource(resource, func(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
-				readResource, e := c.client.ReadResource(ctx, request)
-				if e != nil {
-					return nil, e
-				}
-				return readResource.Contents, nil
-			})
-		}
+		result = append(result, resources.Resources...)
 
 		// 检查是否有更多页面
 		if resources.NextCursor == "" {
@@ -301,35 +536,24 @@ func (c *Client) addResourcesToServer(ctx context.Context, mcpServer *server.MCP
 		}
 		resourcesRequest.Params.Cursor = resources.NextCursor
 	}
-	return nil
+	return result, nil
 }
 
-// addResourceTemplatesToServer 从后端服务获取可用的资源模板列表，并将它们添加到代理的 MCP 服务器
-func (c *Client) addResourceTemplatesToServer(ctx context.Context, mcpServer *server.MCPServer) error {
+// listResourceTemplates 从后端服务获取可用的资源模板列表
+func (c *Client) listResourceTemplates(ctx context.Context, mcpClient *client.Client) ([]mcp.ResourceTemplate, error) {
 	resourceTemplatesRequest := mcp.ListResourceTemplatesRequest{}
+	var result []mcp.ResourceTemplate
 	// 支持分页获取资源模板列表
 	for {
-		resourceTemplates, err := c.client.ListResourceTemplates(ctx, resourceTemplatesRequest)
+		resourceTemplates, err := mcpClient.ListResourceTemplates(ctx, resourceTemplatesRequest)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if len(resourceTemplates.ResourceTemplates) == 0 {
 			break
 		}
 		log.Printf("<%s> Successfully listed %d resource templates", c.name, len(resourceTemplates.ResourceTemplates))
-
-		// 遍历每个资源模板，并将其添加到代理服务器
-		for _, resourceTemplate := range resourceTemplates.ResourceTemplates {
-			log.Printf("<%s> Adding resource template %s", c.name, resourceTemplate.Name)
-			// 为每个资源模板创建一个读取函数，用于处理读取请求
-			mcpServer.AddResourceTemplate(resourceTemplate, func(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
-				readResource, e := c.client.ReadResource(ctx, request)
-				if e != nil {
-					return nil, e
-				}
-				return readResource.Contents, nil
-			})
-		}
+		result = append(result, resourceTemplates.ResourceTemplates...)
 
 		// 检查是否有更多页面
 		if resourceTemplates.NextCursor == "" {
@@ -337,35 +561,359 @@ func (c *Client) addResourceTemplatesToServer(ctx context.Context, mcpServer *se
 		}
 		resourceTemplatesRequest.Params.Cursor = resourceTemplates.NextCursor
 	}
-	return nil
+	return result, nil
+}
+
+// currentClient 返回当前可用的底层客户端，后端未就绪时返回错误
+func (c *Client) currentClient() (*client.Client, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.state != ClientStateReady || c.client == nil {
+		return nil, fmt.Errorf("backend %s is %s", c.name, c.state)
+	}
+	return c.client, nil
+}
+
+// sharedRunning 判断共享的底层客户端是否已连接，按会话隔离的 stdio 后端用它把共享进程计入进程数量上限
+func (c *Client) sharedRunning() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.client != nil
+}
+
+// clientFor 返回处理调用的底层客户端，并返回调用结束后需要调用的 release 函数
+// 转发调用方凭据或按会话隔离时使用下游会话专属的连接，转发的凭据变化时会重新建立连接；否则使用共享的连接
+func (c *Client) clientFor(ctx context.Context) (*client.Client, func(), error) {
+	session := server.ClientSessionFromContext(ctx)
+	if c.sessions == nil || session == nil {
+		return c.sharedClient(ctx)
+	}
+	var headers map[string]string
+	if c.forward != nil {
+		var err error
+		if headers, err = c.forward.render(ctx); err != nil {
+			return nil, nil, fmt.Errorf("failed to render forwarded headers for %s: %w", c.name, err)
+		}
+	}
+	sessionID := session.SessionID()
+	return c.sessions.acquire(ctx, sessionID, headersKey(headers), func(ctx context.Context) (*client.Client, *exec.Cmd, error) {
+		mcpClient, cmd, err := c.dial(ctx, headers, session)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = c.initialize(ctx, mcpClient, cmd); err != nil {
+			return nil, nil, err
+		}
+		mcpClient.OnConnectionLost(func(error) {
+			c.sessions.drop(sessionID, mcpClient)
+		})
+		// 会话连接的通知中只有进度和日志通知需要转发，能力列表由共享的连接提供
+		mcpClient.OnNotification(func(notification mcp.JSONRPCNotification) {
+			c.handleNotification(mcpClient, notification)
+		})
+		if level := c.sessionLogLevel(sessionID); level != "" {
+			c.sendLogLevel(ctx, mcpClient, level)
+		}
+		return mcpClient, cmd, nil
+	})
+}
+
+// closeSession 在下游会话结束时关闭它专属的后端连接
+func (c *Client) closeSession(sessionID string) {
+	if c.sessions != nil {
+		c.sessions.closeSession(sessionID)
+	}
+}
+
+// call 在当前的底层客户端上执行一次转发调用，method 为 MCP 方法名，用于统计耗时
+// 进行中的调用会被记录下来，以便在移除后端时等待它们完成
+func (c *Client) call(ctx context.Context, method string, fn func(ctx context.Context, mcpClient *client.Client) error) error {
+	c.mu.Lock()
+	if c.draining {
+		c.mu.Unlock()
+		return fmt.Errorf("backend %s is shutting down", c.name)
+	}
+	c.inflight.Add(1)
+	c.mu.Unlock()
+	defer c.inflight.Done()
+	defer c.addCaller(ctx)()
+	// 下游取消请求或会话结束时取消转发的调用
+	ctx, stop := linkCancellation(ctx)
+	defer stop()
+
+	mcpClient, release, err := c.clientFor(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	ctx, span := startBackendSpan(ctx, c.name, method)
+	start := time.Now()
+	err = fn(ctx, mcpClient)
+	// stdio 子进程退出后只有 ping 才能发现，调用失败时直接通知监督任务，不必等到下一次 ping
+	if errors.Is(err, transport.ErrTransportClosed) {
+		c.connectionLost(mcpClient, err)
+	}
+	backendCallDuration.WithLabelValues(c.name, method).Observe(time.Since(start).Seconds())
+	endSpan(span, err)
+	return err
+}
+
+// callTool 将工具调用请求转发到后端服务
+// 注册到代理服务器上的是这个方法而不是底层客户端的方法，这样重连后无需重新注册
+func (c *Client) callTool(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	record := AuditRecord{
+		Timestamp: time.Now(),
+		Backend:   c.name,
+		Method:    string(mcp.MethodToolsCall),
+		Name:      request.Params.Name,
+		Arguments: request.Params.Arguments,
+	}
+	var result *mcp.CallToolResult
+	// 先检查调用方的授权作用域，被拒绝的调用同样会记录到审计日志中
+	err := authorizeTool(ctx, c.name, request.Params.Name)
+	if err == nil {
+		err = c.call(ctx, string(mcp.MethodToolsCall), func(ctx context.Context, mcpClient *client.Client) (err error) {
+			trace.SpanFromContext(ctx).SetAttributes(attribute.String("gen_ai.tool.name", request.Params.Name))
+			// 后端的进度通知会被转发给发起调用的下游会话
+			forwarded := request
+			meta, release := c.trackProgress(ctx, request.Params.Meta)
+			defer release()
+			forwarded.Params.Meta = meta
+			result, err = mcpClient.CallTool(ctx, forwarded)
+			return err
+		})
+	}
+	// 后端以 isError 返回的工具执行错误也计为失败
+	callErr := err
+	if callErr == nil && result != nil && result.IsError {
+		callErr = errors.New("tool returned an error")
+	}
+	toolCallsTotal.WithLabelValues(c.name, request.Params.Name, resultLabel(callErr)).Inc()
+	if c.audit.enabled(c.isReadOnlyTool(request.Params.Name)) {
+		record.IsError = result != nil && result.IsError
+		c.audit.write(ctx, record, result, err)
+	}
+	return result, err
+}
+
+// isReadOnlyTool 判断后端的工具是否声明了只读，找不到工具时视为非只读
+func (c *Client) isReadOnlyTool(name string) bool {
+	for _, tool := range c.snapshot().tools {
+		if tool.Name == name {
+			return isReadOnlyTool(tool)
+		}
+	}
+	return false
+}
+
+// getPrompt 将获取提示的请求转发到后端服务
+func (c *Client) getPrompt(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+	record := AuditRecord{
+		Timestamp: time.Now(),
+		Backend:   c.name,
+		Method:    string(mcp.MethodPromptsGet),
+		Name:      request.Params.Name,
+		Arguments: request.Params.Arguments,
+	}
+	var result *mcp.GetPromptResult
+	err := authorizeServer(ctx, c.name)
+	if err == nil {
+		err = c.call(ctx, string(mcp.MethodPromptsGet), func(ctx context.Context, mcpClient *client.Client) (err error) {
+			result, err = mcpClient.GetPrompt(ctx, request)
+			return err
+		})
+	}
+	if c.audit.enabled(true) {
+		c.audit.write(ctx, record, result, err)
+	}
+	return result, err
+}
+
+// readResource 将资源读取请求转发到后端服务，并返回资源内容
+func (c *Client) readResource(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+	record := AuditRecord{
+		Timestamp: time.Now(),
+		Backend:   c.name,
+		Method:    string(mcp.MethodResourcesRead),
+		URI:       request.Params.URI,
+	}
+	var result *mcp.ReadResourceResult
+	err := authorizeServer(ctx, c.name)
+	if err == nil {
+		err = c.call(ctx, string(mcp.MethodResourcesRead), func(ctx context.Context, mcpClient *client.Client) (err error) {
+			result, err = mcpClient.ReadResource(ctx, request)
+			return err
+		})
+	}
+	if c.audit.enabled(true) {
+		c.audit.write(ctx, record, result, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result.Contents, nil
 }
 
-// Close 关闭客户端连接
+// namespace 返回客户端在聚合路由中使用的命名空间前缀
+// 未显式配置时使用服务器名称中第一个 "/" 之前的部分，避免把路由中的令牌暴露到工具名称里
+func (c *Client) namespace() string {
+	if options := c.currentOptions(); options != nil && options.Namespace != "" {
+		return options.Namespace
+	}
+	namespace, _, _ := strings.Cut(c.name, "/")
+	return namespace
+}
+
+// drain 拒绝新的调用，并在超时时间内等待进行中的调用完成，然后关闭客户端连接
+func (c *Client) drain(timeout time.Duration) error {
+	c.mu.Lock()
+	c.draining = true
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("<%s> Drain timed out after %s, closing with calls in flight", c.name, timeout)
+	}
+	return c.Close()
+}
+
+// Close 停止监督任务并关闭客户端连接
 func (c *Client) Close() error {
-	if c.client != nil {
-		return c.client.Close()
+	c.mu.Lock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+	mcpClient, cmd := c.client, c.cmd
+	c.client, c.cmd = nil, nil
+	c.state = ClientStateStopped
+	c.mu.Unlock()
+	if c.sessions != nil {
+		c.sessions.close()
+	}
+	defer c.stderr.Close()
+	if mcpClient != nil {
+		return closeMCPClient(mcpClient, cmd, c.killTimeout)
 	}
 	return nil
 }
 
-// Server 是代理中的服务器组件，封装了 MCP 服务器和 SSE 服务器
+// closeMCPClient 关闭底层客户端，如果 stdio 子进程在 timeout 内没有退出则强制结束它
+func closeMCPClient(mcpClient *client.Client, cmd *exec.Cmd, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- mcpClient.Close()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		if cmd != nil && cmd.Process != nil {
+			_ = cmd.Process.Kill()
+		}
+		return <-done
+	}
+}
+
+// Server 是代理中的服务器组件，封装了 MCP 服务器以及对外提供的 SSE 和 Streamable HTTP 服务器
 type Server struct {
-	tokens    []string          // 认证令牌列表
-	mcpServer *server.MCPServer // MCP 服务器实例，处理 MCP 协议逻辑
-	sseServer *server.SSEServer // SSE 服务器实例，提供 HTTP 接口
+	tokens               []string                     // 认证令牌列表
+	mcpServer            *server.MCPServer            // MCP 服务器实例，处理 MCP 协议逻辑
+	sseServer            *server.SSEServer            // SSE 服务器实例，未启用 SSE 传输时为 nil
+	streamableHTTPServer *server.StreamableHTTPServer // Streamable HTTP 服务器实例，未启用该传输时为 nil
+
+	// origin 返回已注册工具所属的后端和它在后端的原始名称，用于按调用方的授权作用域过滤工具列表
+	origin func(tool string) (backend, name string, ok bool)
+	// sessionClosed 在下游会话结束时被调用，用于关闭会话专属的后端连接，需要在开始处理请求之前设置
+	sessionClosed func(sessionID string)
+	// resourceOwner 返回资源所属的后端，用于转发资源订阅，需要在开始处理请求之前设置
+	resourceOwner func(uri string) (*Client, bool)
+	// backends 返回路由上的所有后端，用于转发日志级别，需要在开始处理请求之前设置
+	backends func() []*Client
+
+	subMu         sync.Mutex
+	sessions      map[string]struct{}           // 已注册且尚未结束的下游会话 ID
+	subscriptions map[string]map[string]*Client // 下游会话 ID -> 订阅的资源 URI -> 资源所属的后端
+
+	reqMu    sync.Mutex
+	requests map[string]map[string]context.CancelCauseFunc // 下游会话 ID -> 进行中的请求 ID -> 取消函数
+}
+
+// filterTools 过滤掉上下文中的调用方无权调用的工具
+func (s *Server) filterTools(ctx context.Context, tools []mcp.Tool) []mcp.Tool {
+	identity := identityFromContext(ctx)
+	if identity == nil || identity.scopes == nil {
+		return tools
+	}
+	return slices.DeleteFunc(tools, func(tool mcp.Tool) bool {
+		backend, name, ok := s.origin(tool.Name)
+		return !ok || !identity.allowsTool(backend, name)
+	})
 }
 
 // newMCPServer 创建一个新的 MCP 服务器实例，用于暴露后端服务的功能
-func newMCPServer(name, version, baseURL string, clientConfig *MCPClientConfig) *Server {
+// options 不能为 nil，load 会为代理和每个后端补全选项
+func newMCPServer(name, version, baseURL string, options *Options) *Server {
+	// 单个后端的路由上，工具名称就是后端的原始名称；聚合路由会替换为从注册表查找
+	srv := &Server{
+		origin: func(tool string) (string, string, bool) {
+			return name, tool, true
+		},
+	}
+
+	// 在请求处理完成时结束链路追踪的服务端 span
+	hooks := &server.Hooks{}
+	addTracingHooks(hooks)
+	hooks.AddOnRegisterSession(func(ctx context.Context, session server.ClientSession) {
+		srv.openSubscriptions(session.SessionID())
+	})
+	hooks.AddOnUnregisterSession(func(ctx context.Context, session server.ClientSession) {
+		srv.cancelRequests(session.SessionID())
+		srv.closeSubscriptions(session.SessionID())
+		srv.closeLogLevels(session.SessionID())
+		if srv.sessionClosed != nil {
+			srv.sessionClosed(session.SessionID())
+		}
+	})
+	// 路由没有提供日志能力时拒绝设置日志级别，并记录请求的取消信号，请求处理完成后移除
+	hooks.AddOnRequestInitialization(func(ctx context.Context, id any, message any) error {
+		if err := srv.checkSetLevel(message); err != nil {
+			return err
+		}
+		srv.trackRequest(ctx, id)
+		return nil
+	})
+	hooks.AddOnSuccess(func(ctx context.Context, id any, method mcp.MCPMethod, message any, result any) {
+		srv.untrackRequest(ctx, id)
+	})
+	hooks.AddOnError(func(ctx context.Context, id any, method mcp.MCPMethod, message any, err error) {
+		srv.untrackRequest(ctx, id)
+	})
+	// 只有路由提供日志能力时才向下游声明
+	hooks.AddAfterInitialize(func(ctx context.Context, id any, message *mcp.InitializeRequest, result *mcp.InitializeResult) {
+		if !srv.loggingEnabled() {
+			result.Capabilities.Logging = nil
+		}
+	})
+	// 下游会话设置日志级别后转发给后端，之后后端的日志消息会转发给该会话
+	hooks.AddAfterSetLevel(func(ctx context.Context, id any, message *mcp.SetLevelRequest, result *mcp.EmptyResult) {
+		srv.setLogLevel(ctx, message.Params.Level)
+	})
+
 	// 准备服务器选项
 	serverOpts := []server.ServerOption{
-		server.WithResourceCapabilities(true, true), // 启用资源能力
+		server.WithToolCapabilities(true),           // 启用工具能力，工具列表变化时通知下游
+		server.WithPromptCapabilities(true),         // 启用提示能力，提示列表变化时通知下游
+		server.WithResourceCapabilities(true, true), // 启用资源能力，资源订阅由 interceptSubscriptions 转发给后端
 		server.WithRecovery(),                       // 启用恢复机制
-	}
-
-	// 如果启用了日志，添加日志选项
-	if clientConfig.Options.LogEnabled.OrElse(false) {
-		serverOpts = append(serverOpts, server.WithLogging())
+		server.WithHooks(hooks),                     // 注册钩子
+		server.WithToolFilter(srv.filterTools),      // 按调用方的授权作用域过滤工具列表
+		server.WithLogging(),                        // 支持日志级别和日志消息，是否向下游声明由 loggingEnabled 决定
 	}
 
 	// 创建 MCP 服务器实例
@@ -375,22 +923,44 @@ func newMCPServer(name, version, baseURL string, clientConfig *MCPClientConfig)
 		serverOpts...,
 	)
 
-	// 创建 SSE 服务器实例，用于提供 HTTP 接口
-	sseServer := server.NewSSEServer(mcpServer,
-		server.WithStaticBasePath(name),
-		server.WithBaseURL(baseURL),
-	)
-
-	// 创建并返回 Server 实例
-	srv := &Server{
-		mcpServer: mcpServer,
-		sseServer: sseServer,
+	srv.mcpServer = mcpServer
+	// 下游取消请求时取消转发给后端的调用
+	mcpServer.AddNotificationHandler(methodNotificationCancelled, srv.cancelRequest)
+
+	// 根据配置创建对外提供的传输层，它们共享同一个 MCP 服务器实例
+	for _, transportType := range options.Transports {
+		switch transportType {
+		case MCPServerTypeSSE:
+			// 创建 SSE 服务器实例，端点为 {route}sse 和 {route}message
+			srv.sseServer = server.NewSSEServer(mcpServer,
+				server.WithStaticBasePath(name),
+				server.WithBaseURL(baseURL),
+			)
+		case MCPServerTypeStreamable:
+			// 创建 Streamable HTTP 服务器实例，端点为 {route}mcp
+			srv.streamableHTTPServer = server.NewStreamableHTTPServer(mcpServer,
+				server.WithStateful(true),
+			)
+		}
 	}
 
 	// 如果配置了认证令牌，设置到 Server 实例
-	if clientConfig.Options != nil && len(clientConfig.Options.AuthTokens) > 0 {
-		srv.tokens = clientConfig.Options.AuthTokens
+	if len(options.AuthTokens) > 0 {
+		srv.tokens = options.AuthTokens
 	}
 
 	return srv
 }
+
+// handler 返回挂载在给定路由下的 HTTP 处理器，
+// 它会把请求分发到已启用的 SSE 或 Streamable HTTP 服务器
+func (s *Server) handler(route string) http.Handler {
+	mux := http.NewServeMux()
+	if s.sseServer != nil {
+		mux.Handle(route, s.sseServer)
+	}
+	if s.streamableHTTPServer != nil {
+		mux.Handle(route+"mcp", s.streamableHTTPServer)
+	}
+	return s.interceptSubscriptions(route, withCancellation(mux))
+}
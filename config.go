@@ -2,7 +2,11 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"maps"
+	"slices"
 	"time"
 
 	"github.com/TBXark/confstore"
@@ -11,22 +15,88 @@ import (
 
 // StdioMCPClientConfig 定义了标准输入/输出类型MCP客户端的配置
 type StdioMCPClientConfig struct {
-	Command string            `json:"command"` // 要执行的命令
-	Env     map[string]string `json:"env"`     // 命令的环境变量
-	Args    []string          `json:"args"`    // 命令的参数
+	Command      string            `json:"command"`      // 要执行的命令
+	Env          map[string]string `json:"env"`          // 命令的环境变量
+	Args         []string          `json:"args"`         // 命令的参数
+	Isolation    IsolationMode     `json:"isolation"`    // 进程隔离方式
+	MaxProcesses int               `json:"maxProcesses"` // 按会话隔离时的最大进程数量，0 表示不限制
+	IdleTimeout  time.Duration     `json:"idleTimeout"`  // 按需启动的进程的空闲超时时间
+	Lazy         bool              `json:"lazy"`         // 是否在第一次调用时才启动进程
+	CatalogFile  string            `json:"catalogFile"`  // 按需启动时缓存能力列表的文件
+	Stderr       *StderrConfig     `json:"stderr"`       // 标准错误输出的处理方式
+	WorkingDir   string            `json:"workingDir"`   // 子进程的工作目录
+	UID          *uint32           `json:"uid"`          // 运行子进程的用户 ID
+	GID          *uint32           `json:"gid"`          // 运行子进程的组 ID
+	Limits       *ProcessLimits    `json:"limits"`       // 子进程的资源限制
+	CleanEnv     bool              `json:"cleanEnv"`     // 是否不继承代理的环境变量
+	InheritEnv   []string          `json:"inheritEnv"`   // 不继承代理的环境变量时仍然继承的变量
+	KillTimeout  time.Duration     `json:"killTimeout"`  // 关闭子进程时等待其退出的时间，超时后强制结束
 }
 
+// ProcessLimits 定义了 stdio 子进程的资源限制，0 表示沿用代理自身的限制
+type ProcessLimits struct {
+	CPUSeconds   uint64 `json:"cpuSeconds,omitempty"`   // CPU 时间（秒），对应 RLIMIT_CPU
+	AddressSpace uint64 `json:"addressSpace,omitempty"` // 虚拟内存大小（字节），对应 RLIMIT_AS
+	OpenFiles    uint64 `json:"openFiles,omitempty"`    // 打开的文件数量，对应 RLIMIT_NOFILE
+	Processes    uint64 `json:"processes,omitempty"`    // 运行子进程的用户的进程数量，对应 RLIMIT_NPROC
+}
+
+// StderrConfig 定义了 stdio 后端标准错误输出的处理方式
+type StderrConfig struct {
+	Log        optional.Field[bool] `json:"log,omitempty"`        // 是否输出到代理的日志，默认为 true
+	Lines      int                  `json:"lines,omitempty"`      // 在管理接口中保留的最近行数，默认为 100
+	File       string               `json:"file,omitempty"`       // 写入的文件路径，为空时不写入文件
+	MaxSize    int                  `json:"maxSize,omitempty"`    // 单个文件的最大大小（MB），超过后轮转，默认为 100
+	MaxBackups int                  `json:"maxBackups,omitempty"` // 保留的旧文件数量，0 表示全部保留
+	MaxAge     int                  `json:"maxAge,omitempty"`     // 旧文件保留的天数，0 表示不按时间删除
+	Compress   bool                 `json:"compress,omitempty"`   // 是否压缩轮转后的旧文件
+}
+
+// IsolationMode 是 stdio 后端进程隔离方式的枚举
+type IsolationMode string
+
+// 进程隔离方式常量
+const (
+	IsolationShared  IsolationMode = "shared"  // 所有下游会话共用一个进程
+	IsolationSession IsolationMode = "session" // 每个下游会话使用独立的进程
+)
+
 // SSEMCPClientConfig 定义了SSE(服务器发送事件)类型MCP客户端的配置
 type SSEMCPClientConfig struct {
-	URL     string            `json:"url"`     // SSE服务器的URL
-	Headers map[string]string `json:"headers"` // 请求头
+	URL     string              `json:"url"`     // SSE服务器的URL
+	Headers map[string]string   `json:"headers"` // 请求头
+	Auth    *UpstreamAuthConfig `json:"auth"`    // OAuth 认证配置
+	Forward *ForwardConfig      `json:"forward"` // 调用方身份转发配置
 }
 
 // StreamableMCPClientConfig 定义了可流式HTTP类型MCP客户端的配置
 type StreamableMCPClientConfig struct {
-	URL     string            `json:"url"`     // HTTP服务器的URL
-	Headers map[string]string `json:"headers"` // 请求头
-	Timeout time.Duration     `json:"timeout"` // 请求超时时间
+	URL     string              `json:"url"`     // HTTP服务器的URL
+	Headers map[string]string   `json:"headers"` // 请求头
+	Timeout time.Duration       `json:"timeout"` // 请求超时时间
+	Auth    *UpstreamAuthConfig `json:"auth"`    // OAuth 认证配置
+	Forward *ForwardConfig      `json:"forward"` // 调用方身份转发配置
+}
+
+// OAuthGrant 是获取后端访问令牌的 OAuth 授权方式的枚举
+type OAuthGrant string
+
+// OAuth 授权方式常量
+const (
+	OAuthGrantClientCredentials OAuthGrant = "client_credentials" // 使用客户端凭据获取令牌
+	OAuthGrantRefreshToken      OAuthGrant = "refresh_token"      // 使用刷新令牌获取令牌
+)
+
+// UpstreamAuthConfig 定义了代理访问受 OAuth 保护的 HTTP 后端时获取访问令牌的方式
+// 访问令牌会被缓存并在过期前刷新，后端返回 401 时会丢弃缓存的令牌并重新获取
+type UpstreamAuthConfig struct {
+	Grant        OAuthGrant        `json:"grant"`                  // 授权方式
+	TokenURL     string            `json:"tokenURL"`               // 授权服务器的令牌端点
+	ClientID     string            `json:"clientId,omitempty"`     // 客户端 ID
+	ClientSecret string            `json:"clientSecret,omitempty"` // 客户端密钥
+	RefreshToken string            `json:"refreshToken,omitempty"` // 刷新令牌，仅用于 refresh_token 授权方式
+	Scopes       []string          `json:"scopes,omitempty"`       // 申请的 scope
+	Params       map[string]string `json:"params,omitempty"`       // 令牌请求的额外参数，例如 audience 或 resource
 }
 
 // MCPClientType 是MCP客户端类型的枚举
@@ -39,6 +109,15 @@ const (
 	MCPClientTypeStreamable MCPClientType = "streamable-http" // 可流式HTTP类型
 )
 
+// MCPServerType 是代理对外提供的传输类型的枚举
+type MCPServerType string
+
+// 代理对外提供的传输类型常量
+const (
+	MCPServerTypeSSE        MCPServerType = "sse"             // 服务器发送事件类型，端点为 {route}sse
+	MCPServerTypeStreamable MCPServerType = "streamable-http" // 可流式HTTP类型，端点为 {route}mcp
+)
+
 // ToolFilterMode 是工具过滤模式的枚举
 type ToolFilterMode string
 
@@ -54,21 +133,206 @@ type ToolFilterConfig struct {
 	List []string       `json:"list,omitempty"` // 工具名称列表
 }
 
+// RestartPolicy 是后端断开后重启策略的枚举
+type RestartPolicy string
+
+// 重启策略常量
+const (
+	RestartPolicyAlways    RestartPolicy = "always"     // 无论后端以何种方式断开都重新连接
+	RestartPolicyOnFailure RestartPolicy = "on-failure" // 仅在后端异常断开时重新连接，stdio 子进程以 0 状态退出时不重启
+	RestartPolicyNever     RestartPolicy = "never"      // 从不重新连接
+)
+
+// RestartConfig 定义了后端断开后的重连配置
+type RestartConfig struct {
+	Policy      RestartPolicy `json:"policy,omitempty"`      // 重启策略，默认为 on-failure
+	MaxRestarts int           `json:"maxRestarts,omitempty"` // 最大重启次数，0 表示不限制
+}
+
+// ClientRequestType 是后端发往客户端的请求类型的枚举
+type ClientRequestType string
+
+// 后端发往客户端的请求类型常量
+const (
+	ClientRequestSampling    ClientRequestType = "sampling"    // sampling/createMessage，请求客户端调用 LLM
+	ClientRequestRoots       ClientRequestType = "roots"       // roots/list，请求客户端的工作区根目录
+	ClientRequestElicitation ClientRequestType = "elicitation" // elicitation/create，请求用户输入
+)
+
 // Options 定义了MCP客户端或代理服务器的通用选项
 type Options struct {
 	PanicIfInvalid optional.Field[bool] `json:"panicIfInvalid,omitempty"` // 如果客户端无效是否panic
 	LogEnabled     optional.Field[bool] `json:"logEnabled,omitempty"`     // 是否启用日志
 	AuthTokens     []string             `json:"authTokens,omitempty"`     // 认证令牌列表
 	ToolFilter     *ToolFilterConfig    `json:"toolFilter,omitempty"`     // 工具过滤配置
+	Namespace      string               `json:"namespace,omitempty"`      // 聚合路由中使用的命名空间前缀，默认为服务器名称
+	Transports     []MCPServerType      `json:"transports,omitempty"`     // 代理对外提供的传输类型，默认同时提供 SSE 和 Streamable HTTP
+	Restart        *RestartConfig       `json:"restart,omitempty"`        // 后端断开后的重连配置
+	Principals     []string             `json:"principals,omitempty"`     // 允许访问的具名调用方，默认为 mcpProxy.principals 中的全部调用方
+	DenyRequests   []ClientRequestType  `json:"denyRequests,omitempty"`   // 不转发给下游会话的后端请求类型，也不会向后端声明对应的能力
+	MirrorLogs     optional.Field[bool] `json:"mirrorLogs,omitempty"`     // 是否把后端发送的日志消息写入代理自身的日志
+
+	principals map[string]*PrincipalConfig // 由 Principals 解析得到的具名调用方
+}
+
+// PrincipalConfig 定义了一个具名调用方
+// 调用方的令牌只能使用作用域内的服务器和工具，作用域形如 "github:list_*"、"fetch" 或 "*"
+type PrincipalConfig struct {
+	Tokens []string `json:"tokens"` // 认证令牌列表
+	Scopes []string `json:"scopes"` // 授权作用域列表
+}
+
+// AggregateConfig 定义了聚合路由的配置
+// 聚合路由通过一个 MCP 会话暴露所有后端的能力，并使用命名空间前缀区分不同后端
+type AggregateConfig struct {
+	Route     string `json:"route,omitempty"`     // 聚合路由名称，默认为 all
+	Separator string `json:"separator,omitempty"` // 命名空间与原始名称之间的分隔符，默认为 __
+}
+
+// Duration 是可以从 JSON 字符串（例如 "30s"）或纳秒数解析的时间间隔
+type Duration time.Duration
+
+// UnmarshalJSON 实现了 json.Unmarshaler 接口
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case float64:
+		*d = Duration(v)
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	return nil
+}
+
+// MarshalJSON 实现了 json.Marshaler 接口
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ReloadConfig 定义了配置热重载的方式
+// 无论是否配置，代理都会在收到 SIGHUP 信号时重新加载配置
+type ReloadConfig struct {
+	Watch        bool     `json:"watch,omitempty"`        // 是否监听本地配置文件的变化
+	PollInterval Duration `json:"pollInterval,omitempty"` // 定期重新拉取 http(s) 配置的间隔，0 表示不轮询
+}
+
+// AdminConfig 定义了管理接口的配置
+// 管理接口监听在独立的地址上，必须配置认证令牌
+type AdminConfig struct {
+	Addr       string               `json:"addr"`                 // 监听地址和端口
+	AuthTokens []string             `json:"authTokens"`           // 认证令牌列表
+	LogEnabled optional.Field[bool] `json:"logEnabled,omitempty"` // 是否启用日志
+}
+
+// MetricsConfig 定义了 Prometheus 指标端点的配置
+type MetricsConfig struct {
+	Addr       string   `json:"addr,omitempty"`       // 独立的监听地址，为空时与代理服务器共用监听地址
+	Path       string   `json:"path,omitempty"`       // 指标端点的路径，默认为 /metrics
+	AuthTokens []string `json:"authTokens,omitempty"` // 认证令牌列表，为空时不需要认证
+}
+
+// TracingExporter 是链路追踪导出方式的枚举
+type TracingExporter string
+
+// 链路追踪导出方式常量
+const (
+	TracingExporterOTLP   TracingExporter = "otlp"   // 通过 OTLP/HTTP 导出到 collector
+	TracingExporterStdout TracingExporter = "stdout" // 输出到标准输出，便于本地调试
+	TracingExporterFile   TracingExporter = "file"   // 以 JSON 追加写入到文件
+)
+
+// TracingConfig 定义了 OpenTelemetry 链路追踪的配置
+type TracingConfig struct {
+	Exporter    TracingExporter         `json:"exporter,omitempty"`    // 导出方式，默认为 otlp
+	Endpoint    string                  `json:"endpoint,omitempty"`    // OTLP/HTTP 端点，例如 http://localhost:4318，为空时使用 OTEL_EXPORTER_OTLP_* 环境变量
+	Headers     map[string]string       `json:"headers,omitempty"`     // 发送到 OTLP 端点的请求头
+	File        string                  `json:"file,omitempty"`        // file 导出方式写入的文件路径
+	SampleRatio optional.Field[float64] `json:"sampleRatio,omitempty"` // 采样比例，取值 0 到 1，默认为 1；上游已采样的请求总是会被采样
+	ServiceName string                  `json:"serviceName,omitempty"` // 服务名称，默认为代理服务器名称
+}
+
+// AuditConfig 定义了审计日志的配置
+// 审计日志以 JSON Lines 格式记录每一次工具调用、资源读取和提示获取
+type AuditConfig struct {
+	File       string   `json:"file"`                 // 审计日志文件路径
+	MaxSize    int      `json:"maxSize,omitempty"`    // 单个文件的最大大小（MB），超过后轮转，默认为 100
+	MaxBackups int      `json:"maxBackups,omitempty"` // 保留的旧文件数量，0 表示全部保留
+	MaxAge     int      `json:"maxAge,omitempty"`     // 旧文件保留的天数，0 表示不按时间删除
+	Compress   bool     `json:"compress,omitempty"`   // 是否压缩轮转后的旧文件
+	Redact     []string `json:"redact,omitempty"`     // 需要脱敏的参数名称，不区分大小写，"*" 表示不记录任何参数
+	WritesOnly bool     `json:"writesOnly,omitempty"` // 是否只记录非只读工具的调用
+}
+
+// JWTConfig 定义了 JWT 令牌的校验方式
+// 配置后所有路由在静态令牌之外都会接受由 JWKS 中的密钥签名的 JWT
+type JWTConfig struct {
+	JWKSURL  string              `json:"jwksURL,omitempty"`  // JWKS 的 URL
+	JWKSFile string              `json:"jwksFile,omitempty"` // 本地 JWKS 文件，用于离线环境
+	CacheTTL Duration            `json:"cacheTTL,omitempty"` // JWKS 的缓存时间，默认为 10 分钟
+	Issuer   string              `json:"issuer,omitempty"`   // 要求的 iss，为空时不检查
+	Audience string              `json:"audience,omitempty"` // 要求的 aud，为空时不检查
+	Leeway   Duration            `json:"leeway,omitempty"`   // 校验 exp、nbf 时允许的时钟偏差
+	Claim    string              `json:"claim,omitempty"`    // 映射授权作用域的声明，支持以 "." 分隔的路径，默认为 groups
+	Scopes   map[string][]string `json:"scopes,omitempty"`   // 声明的取值 -> 授权作用域，"*" 对应所有令牌，没有匹配的取值时不能访问任何服务器
+}
+
+// OAuthConfig 定义了代理作为 OAuth 受保护资源的配置
+// 配置后每个路由都会发布受保护资源元数据，并在认证失败时返回带有元数据地址的 WWW-Authenticate 质询；
+// 访问令牌通过 jwt 配置或令牌内省校验
+type OAuthConfig struct {
+	AuthorizationServers  []string             `json:"authorizationServers"`            // 授权服务器的 issuer 标识
+	ScopesSupported       []string             `json:"scopesSupported,omitempty"`       // 在元数据和质询中公布的 OAuth scope
+	RequiredScopes        []string             `json:"requiredScopes,omitempty"`        // 访问令牌必须全部具有的 OAuth scope，缺少时返回 403
+	ResourceName          string               `json:"resourceName,omitempty"`          // 在元数据中公布的资源名称
+	ResourceDocumentation string               `json:"resourceDocumentation,omitempty"` // 在元数据中公布的文档地址
+	Introspection         *IntrospectionConfig `json:"introspection,omitempty"`         // 令牌内省配置，用于校验不透明令牌
+}
+
+// IntrospectionConfig 定义了 RFC 7662 令牌内省的配置
+type IntrospectionConfig struct {
+	URL          string              `json:"url"`                    // 内省端点
+	ClientID     string              `json:"clientId,omitempty"`     // 调用内省端点时使用的客户端 ID
+	ClientSecret string              `json:"clientSecret,omitempty"` // 调用内省端点时使用的客户端密钥
+	CacheTTL     Duration            `json:"cacheTTL,omitempty"`     // 内省结果的缓存时间，默认为 1 分钟，不会超过令牌的过期时间
+	Audience     string              `json:"audience,omitempty"`     // 要求的 aud，为空时不检查
+	Claim        string              `json:"claim,omitempty"`        // 映射授权作用域的字段，默认为 scope
+	Scopes       map[string][]string `json:"scopes,omitempty"`       // 字段的取值 -> 授权作用域，"*" 对应所有令牌，没有匹配的取值时不能访问任何服务器
+}
+
+// ForwardConfig 定义了如何把下游调用方的身份或凭据转发给 HTTP 后端
+// 配置后每个下游会话使用独立的后端连接，连接的请求头由模板根据下游请求渲染
+type ForwardConfig struct {
+	Headers     map[string]string `json:"headers"`               // 请求头名称 -> text/template 模板，渲染结果为空时不发送
+	SecretsFile string            `json:"secretsFile,omitempty"` // JSON 对象格式的密钥文件，模板中通过 secret 函数读取，文件变化后自动重新读取
+	IdleTimeout Duration          `json:"idleTimeout,omitempty"` // 会话连接的空闲超时时间，默认为 10 分钟
 }
 
 // MCPProxyConfig 定义了MCP代理服务器的配置
 type MCPProxyConfig struct {
-	BaseURL string   `json:"baseURL"`           // 代理服务器的基础URL
-	Addr    string   `json:"addr"`              // 监听地址和端口
-	Name    string   `json:"name"`              // 代理服务器名称
-	Version string   `json:"version"`           // 代理服务器版本
-	Options *Options `json:"options,omitempty"` // 代理服务器选项
+	BaseURL   string           `json:"baseURL"`             // 代理服务器的基础URL
+	Addr      string           `json:"addr"`                // 监听地址和端口
+	Name      string           `json:"name"`                // 代理服务器名称
+	Version   string           `json:"version"`             // 代理服务器版本
+	Options   *Options         `json:"options,omitempty"`   // 代理服务器选项
+	Aggregate *AggregateConfig `json:"aggregate,omitempty"` // 聚合路由配置，为空时不启用
+	Reload    *ReloadConfig    `json:"reload,omitempty"`    // 配置热重载，为空时只响应 SIGHUP
+	Admin     *AdminConfig     `json:"admin,omitempty"`     // 管理接口配置，为空时不启用
+	Metrics   *MetricsConfig   `json:"metrics,omitempty"`   // Prometheus 指标端点配置，为空时不启用
+	Tracing   *TracingConfig   `json:"tracing,omitempty"`   // OpenTelemetry 链路追踪配置，为空时不启用
+	Audit     *AuditConfig     `json:"audit,omitempty"`     // 审计日志配置，为空时不启用
+
+	Principals map[string]*PrincipalConfig `json:"principals,omitempty"` // 具名调用方，键为调用方名称
+	JWT        *JWTConfig                  `json:"jwt,omitempty"`        // JWT 令牌校验配置，为空时不接受 JWT
+	OAuth      *OAuthConfig                `json:"oauth,omitempty"`      // OAuth 受保护资源配置，为空时认证失败只返回 401
 }
 
 // MCPClientConfig 定义了MCP客户端的配置
@@ -82,10 +346,27 @@ type MCPClientConfig struct {
 	Args    []string          `json:"args,omitempty"`    // 参数
 	Env     map[string]string `json:"env,omitempty"`     // 环境变量
 
+	Isolation    IsolationMode `json:"isolation,omitempty"`    // 进程隔离方式，默认为 shared
+	MaxProcesses int           `json:"maxProcesses,omitempty"` // 按会话隔离时的最大进程数量，0 表示不限制
+	IdleTimeout  Duration      `json:"idleTimeout,omitempty"`  // 按需启动的进程的空闲超时时间，默认为 10 分钟
+	Lazy         bool          `json:"lazy,omitempty"`         // 是否在第一次调用时才启动进程，启动前使用缓存的能力列表
+	CatalogFile  string        `json:"catalogFile,omitempty"`  // 按需启动时缓存能力列表的文件，未配置时每次启动代理都会先获取一次
+	Stderr       *StderrConfig `json:"stderr,omitempty"`       // 标准错误输出的处理方式，默认输出到代理的日志
+
+	WorkingDir  string         `json:"workingDir,omitempty"`  // 子进程的工作目录，默认为代理的工作目录
+	UID         *uint32        `json:"uid,omitempty"`         // 运行子进程的用户 ID，默认与代理相同
+	GID         *uint32        `json:"gid,omitempty"`         // 运行子进程的组 ID，默认与代理相同
+	Limits      *ProcessLimits `json:"limits,omitempty"`      // 子进程的资源限制
+	CleanEnv    bool           `json:"cleanEnv,omitempty"`    // 是否不继承代理的环境变量，只使用 inheritEnv 和 env
+	InheritEnv  []string       `json:"inheritEnv,omitempty"`  // 不继承代理的环境变量时仍然继承的变量，例如 PATH
+	KillTimeout Duration       `json:"killTimeout,omitempty"` // 关闭子进程时等待其退出的时间，超时后强制结束，默认为 5 秒
+
 	// SSE或Streamable HTTP类型的配置字段
-	URL     string            `json:"url,omitempty"`     // URL
-	Headers map[string]string `json:"headers,omitempty"` // 请求头
-	Timeout time.Duration     `json:"timeout,omitempty"` // 超时时间，仅用于Streamable HTTP
+	URL     string              `json:"url,omitempty"`     // URL
+	Headers map[string]string   `json:"headers,omitempty"` // 请求头
+	Timeout time.Duration       `json:"timeout,omitempty"` // 超时时间，仅用于Streamable HTTP
+	Auth    *UpstreamAuthConfig `json:"auth,omitempty"`    // OAuth 认证配置，仅用于SSE和Streamable HTTP
+	Forward *ForwardConfig      `json:"forward,omitempty"` // 调用方身份转发配置，仅用于SSE和Streamable HTTP
 
 	Options *Options `json:"options,omitempty"` // 客户端选项
 }
@@ -98,12 +379,32 @@ func parseMCPClientConfig(conf *MCPClientConfig) (any, error) {
 		if conf.Command == "" {
 			return nil, errors.New("command is required for stdio transport")
 		}
+		if conf.Auth != nil || conf.Forward != nil {
+			return nil, errors.New("auth and forward are only supported for sse and streamable-http transports")
+		}
 		return &StdioMCPClientConfig{
-			Command: conf.Command,
-			Env:     conf.Env,
-			Args:    conf.Args,
+			Command:      conf.Command,
+			Env:          conf.Env,
+			Args:         conf.Args,
+			Isolation:    conf.Isolation,
+			MaxProcesses: conf.MaxProcesses,
+			IdleTimeout:  time.Duration(conf.IdleTimeout),
+			Lazy:         conf.Lazy,
+			CatalogFile:  conf.CatalogFile,
+			Stderr:       conf.Stderr,
+			WorkingDir:   conf.WorkingDir,
+			UID:          conf.UID,
+			GID:          conf.GID,
+			Limits:       conf.Limits,
+			CleanEnv:     conf.CleanEnv,
+			InheritEnv:   conf.InheritEnv,
+			KillTimeout:  time.Duration(conf.KillTimeout),
 		}, nil
 	}
+	if conf.Stderr != nil || conf.WorkingDir != "" || conf.UID != nil || conf.GID != nil || conf.Limits != nil ||
+		conf.CleanEnv || conf.InheritEnv != nil || conf.KillTimeout != 0 {
+		return nil, errors.New("stderr, workingDir, uid, gid, limits, cleanEnv, inheritEnv and killTimeout are only supported for stdio transport")
+	}
 	// 如果URL字段存在
 	if conf.URL != "" {
 		// 根据TransportType区分是Streamable HTTP还是SSE
@@ -112,12 +413,16 @@ func parseMCPClientConfig(conf *MCPClientConfig) (any, error) {
 				URL:     conf.URL,
 				Headers: conf.Headers,
 				Timeout: conf.Timeout,
+				Auth:    conf.Auth,
+				Forward: conf.Forward,
 			}, nil
 		} else {
 			// 默认为SSE类型
 			return &SSEMCPClientConfig{
 				URL:     conf.URL,
 				Headers: conf.Headers,
+				Auth:    conf.Auth,
+				Forward: conf.Forward,
 			}, nil
 		}
 	}
@@ -138,6 +443,10 @@ func load(path string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	// 在应用默认值和校验之前展开环境变量和文件引用
+	if err = interpolateConfig(conf); err != nil {
+		return nil, err
+	}
 
 	// 确保必须的配置项存在
 	if conf.McpProxy == nil {
@@ -148,6 +457,150 @@ func load(path string) (*Config, error) {
 	if conf.McpProxy.Options == nil {
 		conf.McpProxy.Options = &Options{}
 	}
+	if conf.McpProxy.Options.Transports == nil {
+		conf.McpProxy.Options.Transports = []MCPServerType{MCPServerTypeSSE, MCPServerTypeStreamable}
+	}
+
+	if conf.McpProxy.Options.Restart == nil {
+		conf.McpProxy.Options.Restart = &RestartConfig{}
+	}
+	if conf.McpProxy.Options.Restart.Policy == "" {
+		conf.McpProxy.Options.Restart.Policy = RestartPolicyOnFailure
+	}
+	if err = validateTransports(conf.McpProxy.Options.Transports); err != nil {
+		return nil, fmt.Errorf("mcpProxy: %w", err)
+	}
+	if err = validateClientRequests(conf.McpProxy.Options.DenyRequests); err != nil {
+		return nil, fmt.Errorf("mcpProxy: %w", err)
+	}
+
+	// 为聚合路由设置默认值，并确保它不会与后端服务器的路由冲突
+	if conf.McpProxy.Aggregate != nil {
+		if conf.McpProxy.Aggregate.Route == "" {
+			conf.McpProxy.Aggregate.Route = "all"
+		}
+		if conf.McpProxy.Aggregate.Separator == "" {
+			conf.McpProxy.Aggregate.Separator = "__"
+		}
+		if _, exists := conf.McpServers[conf.McpProxy.Aggregate.Route]; exists {
+			return nil, fmt.Errorf("aggregate route %q conflicts with mcpServers entry", conf.McpProxy.Aggregate.Route)
+		}
+	}
+
+	// 管理接口可以重启和禁用后端，不允许在没有认证的情况下启用
+	if conf.McpProxy.Admin != nil {
+		if conf.McpProxy.Admin.Addr == "" {
+			return nil, errors.New("mcpProxy.admin: addr is required")
+		}
+		if len(conf.McpProxy.Admin.AuthTokens) == 0 {
+			return nil, errors.New("mcpProxy.admin: authTokens is required")
+		}
+	}
+
+	// 为指标端点设置默认路径
+	if conf.McpProxy.Metrics != nil && conf.McpProxy.Metrics.Path == "" {
+		conf.McpProxy.Metrics.Path = "/metrics"
+	}
+
+	// 为链路追踪设置默认值并校验导出方式
+	if tracing := conf.McpProxy.Tracing; tracing != nil {
+		if tracing.Exporter == "" {
+			tracing.Exporter = TracingExporterOTLP
+		}
+		if tracing.ServiceName == "" {
+			tracing.ServiceName = conf.McpProxy.Name
+		}
+		switch tracing.Exporter {
+		case TracingExporterOTLP, TracingExporterStdout:
+		case TracingExporterFile:
+			if tracing.File == "" {
+				return nil, errors.New("mcpProxy.tracing: file is required for file exporter")
+			}
+		default:
+			return nil, fmt.Errorf("mcpProxy.tracing: unknown exporter %q", tracing.Exporter)
+		}
+		if ratio := tracing.SampleRatio.OrElse(1); ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("mcpProxy.tracing: sampleRatio %v out of range [0, 1]", ratio)
+		}
+	}
+
+	// 审计日志必须指定文件路径
+	if conf.McpProxy.Audit != nil && conf.McpProxy.Audit.File == "" {
+		return nil, errors.New("mcpProxy.audit: file is required")
+	}
+
+	// 校验具名调用方，同一个令牌只能属于一个调用方
+	principalTokens := make(map[string]string)
+	for name, principal := range conf.McpProxy.Principals {
+		if principal == nil || len(principal.Tokens) == 0 {
+			return nil, fmt.Errorf("mcpProxy.principals.%s: tokens is required", name)
+		}
+		for _, token := range principal.Tokens {
+			if owner, exists := principalTokens[token]; exists {
+				return nil, fmt.Errorf("mcpProxy.principals.%s: token is already used by %s", name, owner)
+			}
+			principalTokens[token] = name
+		}
+		for _, value := range principal.Scopes {
+			if err = validateScope(value); err != nil {
+				return nil, fmt.Errorf("mcpProxy.principals.%s: %w", name, err)
+			}
+		}
+	}
+	// 为 JWT 校验设置默认值并校验作用域
+	if jwtConfig := conf.McpProxy.JWT; jwtConfig != nil {
+		if (jwtConfig.JWKSURL == "") == (jwtConfig.JWKSFile == "") {
+			return nil, errors.New("mcpProxy.jwt: exactly one of jwksURL and jwksFile is required")
+		}
+		if jwtConfig.CacheTTL == 0 {
+			jwtConfig.CacheTTL = Duration(10 * time.Minute)
+		}
+		if jwtConfig.Claim == "" {
+			jwtConfig.Claim = "groups"
+		}
+		for value, scopes := range jwtConfig.Scopes {
+			for _, scopeValue := range scopes {
+				if err = validateScope(scopeValue); err != nil {
+					return nil, fmt.Errorf("mcpProxy.jwt.scopes.%s: %w", value, err)
+				}
+			}
+		}
+	}
+	// 作为 OAuth 受保护资源时必须能够校验访问令牌
+	if oauth := conf.McpProxy.OAuth; oauth != nil {
+		if len(oauth.AuthorizationServers) == 0 {
+			return nil, errors.New("mcpProxy.oauth: authorizationServers is required")
+		}
+		if conf.McpProxy.JWT == nil && oauth.Introspection == nil {
+			return nil, errors.New("mcpProxy.oauth: either mcpProxy.jwt or introspection is required to validate access tokens")
+		}
+		if introspection := oauth.Introspection; introspection != nil {
+			if introspection.URL == "" {
+				return nil, errors.New("mcpProxy.oauth.introspection: url is required")
+			}
+			if introspection.CacheTTL == 0 {
+				introspection.CacheTTL = Duration(time.Minute)
+			}
+			if introspection.Claim == "" {
+				introspection.Claim = "scope"
+			}
+			for value, scopes := range introspection.Scopes {
+				for _, scopeValue := range scopes {
+					if err = validateScope(scopeValue); err != nil {
+						return nil, fmt.Errorf("mcpProxy.oauth.introspection.scopes.%s: %w", value, err)
+					}
+				}
+			}
+		}
+	}
+
+	// 代理没有指定允许的调用方时，默认允许所有具名调用方
+	if conf.McpProxy.Options.Principals == nil {
+		conf.McpProxy.Options.Principals = slices.Sorted(maps.Keys(conf.McpProxy.Principals))
+	}
+	if conf.McpProxy.Options.principals, err = resolvePrincipals(conf.McpProxy.Principals, conf.McpProxy.Options.Principals); err != nil {
+		return nil, fmt.Errorf("mcpProxy: %w", err)
+	}
 
 	// 遍历所有后端服务器配置，应用默认值和继承规则
 	for _, clientConfig := range conf.McpServers {
@@ -159,6 +612,24 @@ func load(path string) (*Config, error) {
 		if clientConfig.Options.AuthTokens == nil {
 			clientConfig.Options.AuthTokens = conf.McpProxy.Options.AuthTokens
 		}
+		// Principals继承：如果客户端没有设置允许的调用方，使用代理的设置
+		if clientConfig.Options.Principals == nil {
+			clientConfig.Options.Principals = conf.McpProxy.Options.Principals
+		}
+		// Transports继承：如果客户端没有设置对外传输类型，使用代理的设置
+		if clientConfig.Options.Transports == nil {
+			clientConfig.Options.Transports = conf.McpProxy.Options.Transports
+		}
+		// Restart继承：如果客户端没有设置重连配置，使用代理的设置；只设置了部分字段时补全重启策略
+		if clientConfig.Options.Restart == nil {
+			clientConfig.Options.Restart = conf.McpProxy.Options.Restart
+		} else if clientConfig.Options.Restart.Policy == "" {
+			clientConfig.Options.Restart.Policy = conf.McpProxy.Options.Restart.Policy
+		}
+		// DenyRequests继承：如果客户端没有设置拒绝转发的请求类型，使用代理的设置
+		if clientConfig.Options.DenyRequests == nil {
+			clientConfig.Options.DenyRequests = conf.McpProxy.Options.DenyRequests
+		}
 		// PanicIfInvalid继承：如果客户端没有显式设置此选项，继承代理的设置
 		if !clientConfig.Options.PanicIfInvalid.Present() {
 			clientConfig.Options.PanicIfInvalid = conf.McpProxy.Options.PanicIfInvalid
@@ -167,7 +638,141 @@ func load(path string) (*Config, error) {
 		if !clientConfig.Options.LogEnabled.Present() {
 			clientConfig.Options.LogEnabled = conf.McpProxy.Options.LogEnabled
 		}
+		// MirrorLogs继承：如果客户端没有显式设置此选项，继承代理的设置
+		if !clientConfig.Options.MirrorLogs.Present() {
+			clientConfig.Options.MirrorLogs = conf.McpProxy.Options.MirrorLogs
+		}
+	}
+
+	// 校验每个后端服务器的对外传输类型和重启策略，避免路由在运行时没有任何可用端点
+	for name, clientConfig := range conf.McpServers {
+		if err = validateTransports(clientConfig.Options.Transports); err != nil {
+			return nil, fmt.Errorf("mcpServers.%s: %w", name, err)
+		}
+		if clientConfig.Options.principals, err = resolvePrincipals(conf.McpProxy.Principals, clientConfig.Options.Principals); err != nil {
+			return nil, fmt.Errorf("mcpServers.%s: %w", name, err)
+		}
+		if err = validateClientRequests(clientConfig.Options.DenyRequests); err != nil {
+			return nil, fmt.Errorf("mcpServers.%s: %w", name, err)
+		}
+		switch clientConfig.Options.Restart.Policy {
+		case RestartPolicyAlways, RestartPolicyOnFailure, RestartPolicyNever:
+		default:
+			return nil, fmt.Errorf("mcpServers.%s: unknown restart policy %q", name, clientConfig.Options.Restart.Policy)
+		}
+		if err = validateUpstreamAuth(clientConfig.Auth); err != nil {
+			return nil, fmt.Errorf("mcpServers.%s.auth: %w", name, err)
+		}
+		switch clientConfig.Isolation {
+		case "", IsolationShared, IsolationSession:
+		default:
+			return nil, fmt.Errorf("mcpServers.%s: unknown isolation %q", name, clientConfig.Isolation)
+		}
+		if clientConfig.Isolation == IsolationSession && clientConfig.Command == "" {
+			return nil, fmt.Errorf("mcpServers.%s: session isolation is only supported for stdio servers", name)
+		}
+		if (clientConfig.Lazy || clientConfig.CatalogFile != "") && clientConfig.Command == "" {
+			return nil, fmt.Errorf("mcpServers.%s: lazy start is only supported for stdio servers", name)
+		}
+		if clientConfig.CatalogFile != "" && !clientConfig.Lazy {
+			return nil, fmt.Errorf("mcpServers.%s: catalogFile requires lazy", name)
+		}
+		if clientConfig.MaxProcesses < 0 {
+			return nil, fmt.Errorf("mcpServers.%s: maxProcesses must not be negative", name)
+		}
+		if clientConfig.Command != "" && clientConfig.IdleTimeout == 0 {
+			clientConfig.IdleTimeout = Duration(10 * time.Minute)
+		}
+		// stdio 后端的标准错误输出默认输出到代理的日志
+		if clientConfig.Command != "" {
+			if clientConfig.Stderr == nil {
+				clientConfig.Stderr = &StderrConfig{}
+			}
+			if clientConfig.Stderr.Lines < 0 {
+				return nil, fmt.Errorf("mcpServers.%s.stderr: lines must not be negative", name)
+			}
+			if clientConfig.Stderr.Lines == 0 {
+				clientConfig.Stderr.Lines = 100
+			}
+			if clientConfig.InheritEnv != nil && !clientConfig.CleanEnv {
+				return nil, fmt.Errorf("mcpServers.%s: inheritEnv requires cleanEnv", name)
+			}
+			if clientConfig.KillTimeout == 0 {
+				clientConfig.KillTimeout = Duration(stopTimeout)
+			}
+		}
+		if forward := clientConfig.Forward; forward != nil {
+			if _, err = parseForwardHeaders(forward.Headers, nil); err != nil {
+				return nil, fmt.Errorf("mcpServers.%s.forward: %w", name, err)
+			}
+			if forward.IdleTimeout == 0 {
+				forward.IdleTimeout = Duration(10 * time.Minute)
+			}
+		}
 	}
 
 	return conf, nil
 }
+
+// resolvePrincipals 根据名称查找允许访问的具名调用方
+func resolvePrincipals(principals map[string]*PrincipalConfig, names []string) (map[string]*PrincipalConfig, error) {
+	resolved := make(map[string]*PrincipalConfig, len(names))
+	for _, name := range names {
+		principal, ok := principals[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown principal %q", name)
+		}
+		resolved[name] = principal
+	}
+	return resolved, nil
+}
+
+// validateUpstreamAuth 检查后端的 OAuth 认证配置是否完整
+func validateUpstreamAuth(auth *UpstreamAuthConfig) error {
+	if auth == nil {
+		return nil
+	}
+	if auth.TokenURL == "" {
+		return errors.New("tokenURL is required")
+	}
+	switch auth.Grant {
+	case OAuthGrantClientCredentials:
+		if auth.ClientID == "" {
+			return errors.New("clientId is required for the client_credentials grant")
+		}
+	case OAuthGrantRefreshToken:
+		if auth.RefreshToken == "" {
+			return errors.New("refreshToken is required for the refresh_token grant")
+		}
+	default:
+		return fmt.Errorf("unknown grant %q", auth.Grant)
+	}
+	return nil
+}
+
+// validateTransports 检查对外传输类型列表是否非空且只包含已知类型
+func validateTransports(transports []MCPServerType) error {
+	if len(transports) == 0 {
+		return errors.New("transports must not be empty")
+	}
+	for _, transportType := range transports {
+		switch transportType {
+		case MCPServerTypeSSE, MCPServerTypeStreamable:
+		default:
+			return fmt.Errorf("unknown transport %q", transportType)
+		}
+	}
+	return nil
+}
+
+// validateClientRequests 检查拒绝转发的请求类型列表是否只包含已知类型
+func validateClientRequests(kinds []ClientRequestType) error {
+	for _, kind := range kinds {
+		switch kind {
+		case ClientRequestSampling, ClientRequestRoots, ClientRequestElicitation:
+		default:
+			return fmt.Errorf("unknown request type %q in denyRequests", kind)
+		}
+	}
+	return nil
+}
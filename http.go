@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"log"
 	"net/http"
@@ -9,17 +10,28 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
-
-	"github.com/mark3labs/mcp-go/mcp"
-	"golang.org/x/sync/errgroup"
 )
 
 // MiddlewareFunc 定义了中间件函数的类型，它接收一个 http.Handler 并返回一个新的 http.Handler。
 type MiddlewareFunc func(http.Handler) http.Handler
 
+// maxRequestBodySize 是 POST 到路由的 JSON-RPC 消息的最大字节数，读取消息的中间件都会按它限制请求体
+const maxRequestBodySize = 10 << 20
+
+// writeBodyError 在读取请求体失败时写出错误响应，请求体超过 maxRequestBodySize 时返回 413。
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "Bad Request", http.StatusBadRequest)
+}
+
 // chainMiddleware 将一系列中间件处理器应用于一个 http.Handler。
 func chainMiddleware(h http.Handler, middlewares ...MiddlewareFunc) http.Handler {
 	for _, mw := range middlewares {
@@ -29,35 +41,63 @@ func chainMiddleware(h http.Handler, middlewares ...MiddlewareFunc) http.Handler
 }
 
 // newAuthMiddleware 创建一个中间件，该中间件基于一个有效的令牌列表来强制执行身份验证。
-func newAuthMiddleware(tokens []string) MiddlewareFunc {
-	tokenSet := make(map[string]struct{}, len(tokens))
+// 除了不受限制的令牌之外，还可以接受具名调用方的令牌，它们只能使用自己作用域内的服务器和工具；
+// 配置了访问令牌校验器时，不在列表中的令牌会通过 JWT 校验或令牌内省，并按声明映射作用域。
+// challenge 不为 nil 时，认证失败的响应会带有指向受保护资源元数据的 WWW-Authenticate 质询。
+func newAuthMiddleware(tokens []string, principals map[string]*PrincipalConfig, verifier *tokenVerifier, challenge *oauthChallenge) MiddlewareFunc {
+	identities := make(map[string]*Identity, len(tokens))
 	for _, token := range tokens {
-		tokenSet[token] = struct{}{}
+		identities[token] = &Identity{TokenHash: hashToken(token)}
+	}
+	for name, principal := range principals {
+		scopes := parseScopes(principal.Scopes)
+		for _, token := range principal.Tokens {
+			identities[token] = &Identity{TokenHash: hashToken(token), Principal: name, scopes: scopes}
+		}
 	}
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if len(tokens) != 0 {
+			if len(identities) != 0 || verifier != nil {
 				token := r.Header.Get("Authorization")
 				token = strings.TrimSpace(strings.TrimPrefix(token, "Bearer "))
 				if token == "" {
-					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					challenge.unauthorized(w, "", "")
 					return
 				}
-				if _, ok := tokenSet[token]; !ok {
-					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				identity, ok := identities[token]
+				verified := false
+				if !ok && verifier != nil {
+					var err error
+					if identity, err = verifier.verify(r.Context(), token); err != nil {
+						log.Printf("Rejected access token from %s: %v", r.RemoteAddr, err)
+						challenge.unauthorized(w, "invalid_token", "The access token is invalid or expired")
+						return
+					}
+					ok, verified = true, true
+				}
+				if !ok {
+					challenge.unauthorized(w, "invalid_token", "The access token is invalid")
 					return
 				}
+				if !challenge.authorize(w, identity, verified) {
+					return
+				}
+				r = r.WithContext(withIdentity(r.Context(), identity))
 			}
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-// loggerMiddleware 创建一个中间件，用给定的前缀记录传入的请求。
+// loggerMiddleware 创建一个中间件，用给定的前缀记录传入的请求，通过认证的请求还会记录调用方。
 func loggerMiddleware(prefix string) MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			log.Printf("<%s> Request [%s] %s", prefix, r.Method, r.URL.Path)
+			if identity := identityFromContext(r.Context()); identity != nil {
+				log.Printf("<%s> Request [%s] %s (caller %s)", prefix, r.Method, r.URL.Path, identity.caller())
+			} else {
+				log.Printf("<%s> Request [%s] %s", prefix, r.Method, r.URL.Path)
+			}
 			next.ServeHTTP(w, r)
 		})
 	}
@@ -79,94 +119,125 @@ func recoverMiddleware(prefix string) MiddlewareFunc {
 	}
 }
 
+// readinessMiddleware 创建一个中间件，在后端首次连接成功之前以 503 响应请求，
+// 并在响应体中以 JSON 返回后端的当前状态（最近的错误、下一次重试时间等）。
+// 使用缓存的能力列表、尚未启动的按需启动后端可以直接处理请求。
+func readinessMiddleware(c *Client) MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			status := c.status()
+			if status.ConnectedAt == nil && status.State != ClientStateIdle {
+				w.Header().Set("Content-Type", "application/json")
+				if status.NextRetry != nil {
+					retryAfter := max(int(time.Until(*status.NextRetry).Seconds()), 1)
+					w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				}
+				w.WriteHeader(http.StatusServiceUnavailable)
+				_ = json.NewEncoder(w).Encode(status)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// routeContextMiddleware 创建一个中间件，在给定的上下文结束时取消请求的上下文，
+// 用于在路由被卸载后结束仍然挂在该路由上的 SSE 长连接。
+func routeContextMiddleware(ctx context.Context) MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reqCtx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+			stop := context.AfterFunc(ctx, cancel)
+			defer stop()
+			next.ServeHTTP(w, r.WithContext(reqCtx))
+		})
+	}
+}
+
+// newRouteMiddlewares 根据选项为一个路由动态构建中间件链。
+// verifier 为 nil 时只接受静态令牌，oauth 为 nil 时认证失败不返回 OAuth 质询。
+func newRouteMiddlewares(name string, options *Options, verifier *tokenVerifier, oauth *oauthResource) []MiddlewareFunc {
+	middlewares := make([]MiddlewareFunc, 0)
+	middlewares = append(middlewares, recoverMiddleware(name))
+	if options.LogEnabled.OrElse(false) {
+		middlewares = append(middlewares, loggerMiddleware(name))
+	}
+	if len(options.AuthTokens) > 0 || len(options.principals) > 0 || verifier != nil {
+		middlewares = append(middlewares, newAuthMiddleware(options.AuthTokens, options.principals, verifier, oauth.challenge(name)))
+	}
+	return middlewares
+}
+
+// routePath 为给定名称的 MCP 服务器构建唯一的路由，路由总是以 "/" 开头和结尾。
+func routePath(baseURL *url.URL, name string) string {
+	mcpRoute := path.Join(baseURL.Path, name)
+	if !strings.HasPrefix(mcpRoute, "/") {
+		mcpRoute = "/" + mcpRoute
+	}
+	if !strings.HasSuffix(mcpRoute, "/") {
+		mcpRoute += "/"
+	}
+	return mcpRoute
+}
+
 // startHTTPServer 根据提供的配置初始化并启动主 HTTP 代理服务器。
-// 它负责设置路由、中间件和优雅停机处理。
-func startHTTPServer(config *Config) error {
+// 它负责设置路由、中间件、配置热重载和优雅停机处理。
+func startHTTPServer(configPath string, config *Config) error {
 
-	baseURL, err := url.Parse(config.McpProxy.BaseURL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 初始化链路追踪，停机时刷新尚未导出的 span。
+	shutdownTracing, err := setupTracing(ctx, config.McpProxy.Tracing, config.McpProxy.Version)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		_ = shutdownTracing(context.Background())
+	}()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// 创建代理并应用启动时的配置，路由会立即挂载，后端在后台并发地初始化。
+	p, err := newProxy(ctx, configPath, config)
+	if err != nil {
+		return err
+	}
+	if err = p.apply(config, true); err != nil {
+		return err
+	}
 
-	var errorGroup errgroup.Group
-	httpMux := http.NewServeMux()
 	httpServer := &http.Server{
 		Addr:    config.McpProxy.Addr,
-		Handler: httpMux,
-	}
-	info := mcp.Implementation{
-		Name:    config.McpProxy.Name,
-		Version: config.McpProxy.Version,
+		Handler: p,
 	}
+	// 注册一个关闭函数，以便在服务器关闭时优雅地关闭客户端连接。
+	httpServer.RegisterOnShutdown(p.close)
 
-	// 遍历每个配置的 MCP 服务器，以设置其客户端和路由。
-	for name, clientConfig := range config.McpServers {
-		// 为代理创建一个新的 MCP 客户端和相应的服务器实例。
-		mcpClient, err := newMCPClient(name, clientConfig)
-		if err != nil {
-			log.Fatalf("<%s> Failed to create client: %v", name, err)
-		}
-		server := newMCPServer(name, config.McpProxy.Version, config.McpProxy.BaseURL, clientConfig)
-		// 并发地初始化每个客户端并将其添加到 HTTP 服务器。
-		errorGroup.Go(func() error {
-			log.Printf("<%s> Connecting", name)
-			// 连接到后端 MCP 服务，并将其能力（工具等）注册到代理的服务器实例中。
-			addErr := mcpClient.addToMCPServer(ctx, info, server.mcpServer)
-			if addErr != nil {
-				log.Printf("<%s> Failed to add client to server: %v", name, addErr)
-				// 如果 PanicIfInvalid 为 true，此处的失败将导致整个代理服务停止启动。
-				if clientConfig.Options.PanicIfInvalid.OrElse(false) {
-					return addErr
-				}
-				return nil
-			}
-			log.Printf("<%s> Connected", name)
+	// 在收到 SIGHUP 信号或配置文件发生变化时重新加载配置。
+	if err = watchConfig(ctx, p, config.McpProxy.Reload); err != nil {
+		return err
+	}
 
-			// 根据其配置，为此特定路由动态构建中间件链。
-			middlewares := make([]MiddlewareFunc, 0)
-			middlewares = append(middlewares, recoverMiddleware(name))
-			if clientConfig.Options.LogEnabled.OrElse(false) {
-				middlewares = append(middlewares, loggerMiddleware(name))
-			}
-			if len(clientConfig.Options.AuthTokens) > 0 {
-				middlewares = append(middlewares, newAuthMiddleware(clientConfig.Options.AuthTokens))
-			}
-			// 为此 MCP 服务器构建唯一的路由。
-			mcpRoute := path.Join(baseURL.Path, name)
-			if !strings.HasPrefix(mcpRoute, "/") {
-				mcpRoute = "/" + mcpRoute
-			}
-			if !strings.HasSuffix(mcpRoute, "/") {
-				mcpRoute += "/"
-			}
-			// 为特定的 MCP 服务器路由注册最终的处理程序，该处理程序被其自己的中间件包裹。
-			httpMux.Handle(mcpRoute, chainMiddleware(server.sseServer, middlewares...))
-			// 注册一个关闭函数，以便在服务器关闭时优雅地关闭客户端连接。
-			httpServer.RegisterOnShutdown(func() {
-				log.Printf("<%s> Shutting down", name)
-				_ = mcpClient.Close()
-			})
-			return nil
+	// 如果配置了管理接口，在独立的地址上启动它，并随主服务器一起关闭。
+	if config.McpProxy.Admin != nil {
+		adminServer := startAdminServer(p, config.McpProxy.Admin)
+		httpServer.RegisterOnShutdown(func() {
+			_ = adminServer.Close()
 		})
 	}
 
-	// 启动一个 goroutine，等待所有客户端成功初始化。
-	// 如果任何客户端初始化失败并配置为 panic，这将导致致命错误。
-	go func() {
-		err := errorGroup.Wait()
-		if err != nil {
-			log.Fatalf("Failed to add clients: %v", err)
-		}
-		log.Printf("All clients initialized")
-	}()
+	// 如果配置了独立的指标监听地址，在该地址上暴露指标，否则指标挂载在代理服务器上。
+	if config.McpProxy.Metrics != nil && config.McpProxy.Metrics.Addr != "" {
+		metricsServer := startMetricsServer(config.McpProxy.Metrics)
+		httpServer.RegisterOnShutdown(func() {
+			_ = metricsServer.Close()
+		})
+	}
 
 	// 在一个单独的 goroutine 中启动主 HTTP 服务器。
 	go func() {
-		log.Printf("Starting SSE server")
-		log.Printf("SSE server listening on %s", config.McpProxy.Addr)
+		log.Printf("Starting MCP proxy server")
+		log.Printf("MCP proxy server listening on %s", config.McpProxy.Addr)
 		hErr := httpServer.ListenAndServe()
 		if hErr != nil && !errors.Is(hErr, http.ErrServerClosed) {
 			log.Fatalf("Failed to start server: %v", hErr)
@@ -0,0 +1,214 @@
+// interpolate.go 文件实现了配置中的变量引用。
+// 配置中任意字符串字段都可以使用 ${ENV_VAR}、${ENV_VAR:-default} 引用环境变量，使用 ${file:/path} 引用文件内容，
+// 这样令牌等敏感信息无需以明文写在配置文件中；$${ 会被展开为字面的 ${。
+// 从环境变量或文件展开得到的值都会从代理的日志输出中隐去，只有字面的默认值保持原样，错误信息中也只包含引用本身。
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const fileReferencePrefix = "file:" // 引用文件内容的前缀
+
+var (
+	// referencePattern 匹配 ${...} 形式的引用以及转义用的 $${
+	referencePattern = regexp.MustCompile(`\$\$\{|\$\{([^}]*)\}`)
+	// envNamePattern 匹配合法的环境变量名称
+	envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// interpolator 展开配置中的引用，并记录无法解析的引用和展开得到的值
+type interpolator struct {
+	unresolved []string // 无法解析的引用，格式为 "字段路径: 引用"
+	values     []string // 展开得到的敏感值，需要从日志中隐去
+}
+
+// interpolateConfig 展开配置中所有字符串字段里的引用，存在无法解析的引用时返回列出所有引用的错误
+func interpolateConfig(conf *Config) error {
+	i := &interpolator{}
+	i.walk(reflect.ValueOf(conf).Elem(), "")
+	if len(i.unresolved) > 0 {
+		slices.Sort(i.unresolved)
+		return fmt.Errorf("unresolved references in config: %s", strings.Join(i.unresolved, "; "))
+	}
+	logRedactor.add(i.values...)
+	return nil
+}
+
+// walk 递归展开结构体、指针、切片和映射中的字符串，path 是字段在配置中的路径，用于错误信息
+// 未导出的字段不是从配置文件中读取的，会被跳过
+func (i *interpolator) walk(v reflect.Value, path string) {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			i.walk(v.Elem(), path)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for index := range t.NumField() {
+			field := t.Field(index)
+			if !field.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			i.walk(v.Field(index), joinConfigPath(path, name))
+		}
+	case reflect.Slice, reflect.Array:
+		for index := range v.Len() {
+			i.walk(v.Index(index), fmt.Sprintf("%s[%d]", path, index))
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			elem := v.MapIndex(key)
+			elemPath := joinConfigPath(path, fmt.Sprint(key.Interface()))
+			// 映射中的字符串不可寻址，需要展开后重新写入
+			if elem.Kind() == reflect.String {
+				v.SetMapIndex(key, reflect.ValueOf(i.expand(elem.String(), elemPath)).Convert(elem.Type()))
+				continue
+			}
+			i.walk(elem, elemPath)
+		}
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(i.expand(v.String(), path))
+		}
+	}
+}
+
+// expand 展开字符串中的引用，无法解析的引用保持原样并被记录下来
+func (i *interpolator) expand(s, path string) string {
+	if !strings.Contains(s, "${") {
+		return s
+	}
+	return referencePattern.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$${" {
+			return "${"
+		}
+		value, literal, err := resolveReference(match[2 : len(match)-1])
+		if err != nil {
+			i.unresolved = append(i.unresolved, fmt.Sprintf("%s: %s (%v)", path, match, err))
+			return match
+		}
+		// 空值无法也无需隐去
+		if !literal && value != "" {
+			i.values = append(i.values, value)
+		}
+		return value
+	})
+}
+
+// resolveReference 解析一个引用，literal 表示返回的是配置中字面的默认值，返回的错误中不包含任何引用的值
+func resolveReference(ref string) (value string, literal bool, err error) {
+	if path, ok := strings.CutPrefix(ref, fileReferencePrefix); ok {
+		if path == "" {
+			return "", false, errors.New("empty file path")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to read file: %w", unwrapPathError(err))
+		}
+		// 密钥文件通常以换行符结尾
+		return strings.TrimRight(string(data), "\r\n"), false, nil
+	}
+	name, fallback, hasDefault := strings.Cut(ref, ":-")
+	if !envNamePattern.MatchString(name) {
+		return "", false, errors.New("invalid environment variable name")
+	}
+	value, ok := os.LookupEnv(name)
+	if hasDefault && value == "" {
+		return fallback, true, nil
+	}
+	if !ok {
+		return "", false, errors.New("environment variable is not set")
+	}
+	return value, false, nil
+}
+
+// unwrapPathError 返回文件操作错误的原因，路径已经包含在引用中
+func unwrapPathError(err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	return err
+}
+
+// joinConfigPath 拼接配置字段的路径
+func joinConfigPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// logRedactor 从代理的日志输出中隐去配置中展开得到的值
+var logRedactor = &redactor{}
+
+// redactor 把写入的内容中的敏感值替换为 [REDACTED]
+type redactor struct {
+	mu       sync.Mutex
+	values   []string
+	replacer atomic.Pointer[strings.Replacer]
+}
+
+// add 添加需要隐去的值，重新加载配置后旧的值仍然会被隐去
+func (r *redactor) add(values ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	added := false
+	for _, value := range values {
+		if !slices.Contains(r.values, value) {
+			r.values = append(r.values, value)
+			added = true
+		}
+	}
+	if !added {
+		return
+	}
+	// 先替换较长的值，避免其中包含的较短的值被单独替换
+	sorted := slices.Clone(r.values)
+	slices.SortFunc(sorted, func(a, b string) int { return len(b) - len(a) })
+	pairs := make([]string, 0, len(sorted)*2)
+	for _, value := range sorted {
+		pairs = append(pairs, value, redacted)
+	}
+	r.replacer.Store(strings.NewReplacer(pairs...))
+}
+
+// writer 返回隐去敏感值后再写入 out 的 io.Writer
+func (r *redactor) writer(out io.Writer) io.Writer {
+	return redactingWriter{redactor: r, out: out}
+}
+
+// redactingWriter 是隐去敏感值的 io.Writer
+type redactingWriter struct {
+	redactor *redactor
+	out      io.Writer
+}
+
+// Write 隐去敏感值后写入，返回的长度是原始内容的长度
+func (w redactingWriter) Write(p []byte) (int, error) {
+	replacer := w.redactor.replacer.Load()
+	if replacer == nil {
+		return w.out.Write(p)
+	}
+	if _, err := io.WriteString(w.out, replacer.Replace(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestResolveReference(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secretFile, []byte("s3cret-value\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PROXY_TEST_SET", "value")
+	t.Setenv("PROXY_TEST_EMPTY", "")
+
+	tests := []struct {
+		ref         string
+		want        string
+		wantLiteral bool
+		wantErr     string
+	}{
+		{ref: "PROXY_TEST_SET", want: "value"},
+		{ref: "PROXY_TEST_SET:-fallback", want: "value"},
+		{ref: "PROXY_TEST_EMPTY", want: ""},
+		{ref: "PROXY_TEST_EMPTY:-fallback", want: "fallback", wantLiteral: true},
+		{ref: "PROXY_TEST_UNSET:-fallback", want: "fallback", wantLiteral: true},
+		{ref: "PROXY_TEST_UNSET:-", want: "", wantLiteral: true},
+		{ref: "PROXY_TEST_UNSET", wantErr: "environment variable is not set"},
+		{ref: "1INVALID", wantErr: "invalid environment variable name"},
+		{ref: "", wantErr: "invalid environment variable name"},
+		{ref: "file:" + secretFile, want: "s3cret-value"},
+		{ref: "file:", wantErr: "empty file path"},
+		{ref: "file:" + filepath.Join(dir, "missing"), wantErr: "failed to read file: no such file or directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, literal, err := resolveReference(tt.ref)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("resolveReference(%q) error = %v, want %q", tt.ref, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveReference(%q) error = %v", tt.ref, err)
+			}
+			if got != tt.want || literal != tt.wantLiteral {
+				t.Errorf("resolveReference(%q) = %q, literal %v, want %q, literal %v", tt.ref, got, literal, tt.want, tt.wantLiteral)
+			}
+		})
+	}
+}
+
+func TestExpand(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("file-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PROXY_TEST_HOME", "/home/proxy")
+	t.Setenv("PROXY_TEST_PASS", "pw")
+	t.Setenv("PROXY_TEST_EMPTY", "")
+
+	tests := []struct {
+		name           string
+		path           string
+		input          string
+		want           string
+		wantValues     []string
+		wantUnresolved int
+	}{
+		{name: "no references", path: "args[0]", input: "plain $HOME text", want: "plain $HOME text"},
+		{name: "escape", path: "args[1]", input: "echo $${HOME}", want: "echo ${HOME}"},
+		{name: "escape next to reference", path: "args[1]", input: "$${PROXY_TEST_HOME}=${PROXY_TEST_HOME}", want: "${PROXY_TEST_HOME}=/home/proxy", wantValues: []string{"/home/proxy"}},
+		{name: "environment variable", path: "args[0]", input: "${PROXY_TEST_HOME}/bin", want: "/home/proxy/bin", wantValues: []string{"/home/proxy"}},
+		{name: "short value inside a url", path: "mcpServers.a.env.DATABASE_URL", input: "postgres://u:${PROXY_TEST_PASS}@db/app", want: "postgres://u:pw@db/app", wantValues: []string{"pw"}},
+		{name: "flag value", path: "args[2]", input: "--token=${PROXY_TEST_PASS}", want: "--token=pw", wantValues: []string{"pw"}},
+		{name: "set variable ignores the default", path: "url", input: "${PROXY_TEST_PASS:-abc}", want: "pw", wantValues: []string{"pw"}},
+		{name: "default is not redacted", path: "url", input: "http://${PROXY_TEST_UNSET:-localhost:8080}/mcp", want: "http://localhost:8080/mcp"},
+		{name: "default in a secret field is not redacted", path: "authTokens[0]", input: "${PROXY_TEST_UNSET:-abc}", want: "abc"},
+		{name: "empty value", path: "args[0]", input: "a${PROXY_TEST_EMPTY}b", want: "ab"},
+		{name: "file reference", path: "args[0]", input: "${file:" + tokenFile + "}", want: "file-token", wantValues: []string{"file-token"}},
+		{name: "unresolved reference is kept", path: "args[0]", input: "sh -c ${PROXY_TEST_UNSET}", want: "sh -c ${PROXY_TEST_UNSET}", wantUnresolved: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := &interpolator{}
+			if got := i.expand(tt.input, tt.path); got != tt.want {
+				t.Errorf("expand(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+			if !slices.Equal(i.values, tt.wantValues) {
+				t.Errorf("redacted values = %q, want %q", i.values, tt.wantValues)
+			}
+			if len(i.unresolved) != tt.wantUnresolved {
+				t.Errorf("unresolved = %q, want %d entries", i.unresolved, tt.wantUnresolved)
+			}
+			for _, entry := range i.unresolved {
+				if !strings.HasPrefix(entry, tt.path+": ") {
+					t.Errorf("unresolved entry %q does not name the field %q", entry, tt.path)
+				}
+			}
+		})
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	tests := []struct {
+		name   string
+		values [][]string
+		input  string
+		want   string
+	}{
+		{
+			name:  "nothing to redact",
+			input: "plain line",
+			want:  "plain line",
+		},
+		{
+			name:   "longer value wins over its prefix",
+			values: [][]string{{"secret", "secret-extended"}},
+			input:  "a secret-extended b secret",
+			want:   "a [REDACTED] b [REDACTED]",
+		},
+		{
+			name:   "ordering holds across reloads",
+			values: [][]string{{"abcdef"}, {"abcdefghij"}},
+			input:  "abcdefghij abcdef",
+			want:   "[REDACTED] [REDACTED]",
+		},
+		{
+			name:   "duplicates are ignored",
+			values: [][]string{{"token-1", "token-1"}, {"token-1"}},
+			input:  "token-1",
+			want:   "[REDACTED]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &redactor{}
+			for _, values := range tt.values {
+				r.add(values...)
+			}
+			var out bytes.Buffer
+			n, err := r.writer(&out).Write([]byte(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(tt.input) {
+				t.Errorf("Write returned %d, want %d", n, len(tt.input))
+			}
+			if out.String() != tt.want {
+				t.Errorf("output = %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
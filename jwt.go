@@ -0,0 +1,315 @@
+// jwt.go 文件实现了 JWT 令牌的校验。
+// 签名密钥从 JWKS（URL 或本地文件）加载并缓存，遇到未知的 kid 时会提前刷新；
+// 校验通过的令牌会根据配置的声明（例如 groups）映射为授权作用域。
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	jwksFetchTimeout   = 10 * time.Second // 拉取 JWKS 的超时时间
+	jwksMinRefreshWait = time.Minute      // 因未知 kid 触发刷新的最小间隔，避免伪造的令牌导致频繁拉取
+)
+
+// jwtVerifier 负责校验 JWT 并把声明转换为调用方身份
+type jwtVerifier struct {
+	conf   *JWTConfig
+	parser *jwt.Parser
+	keys   *jwksCache
+}
+
+// newJWTVerifier 根据配置创建 JWT 校验器，未配置时返回 nil
+func newJWTVerifier(conf *JWTConfig) *jwtVerifier {
+	if conf == nil {
+		return nil
+	}
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Duration(conf.Leeway)),
+	}
+	if conf.Issuer != "" {
+		options = append(options, jwt.WithIssuer(conf.Issuer))
+	}
+	if conf.Audience != "" {
+		options = append(options, jwt.WithAudience(conf.Audience))
+	}
+	return &jwtVerifier{
+		conf:   conf,
+		parser: jwt.NewParser(options...),
+		keys: &jwksCache{
+			url:  conf.JWKSURL,
+			file: conf.JWKSFile,
+			ttl:  time.Duration(conf.CacheTTL),
+		},
+	}
+}
+
+// verify 校验令牌的签名和 iss、aud、exp 等声明，并返回对应的调用方身份
+func (v *jwtVerifier) verify(ctx context.Context, raw string) (*Identity, error) {
+	claims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(raw, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return v.keys.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return identityFromClaims(raw, claims, v.conf.Claim, v.conf.Scopes), nil
+}
+
+// identityFromClaims 根据校验通过的令牌声明创建调用方身份
+// 只授予声明中的取值对应的作用域，映射中 "*" 对应的作用域授予所有令牌；没有匹配的映射时不能访问任何服务器
+func identityFromClaims(raw string, claims map[string]any, claim string, mapping map[string][]string) *Identity {
+	identity := &Identity{
+		TokenHash:   hashToken(raw),
+		oauthScopes: append(claimValues(claims, "scope"), claimValues(claims, "scp")...),
+		scopes:      parseScopes(mapping["*"]),
+	}
+	identity.Subject, _ = claims["sub"].(string)
+	for _, value := range claimValues(claims, claim) {
+		if value != "*" {
+			identity.scopes = append(identity.scopes, parseScopes(mapping[value])...)
+		}
+	}
+	return identity
+}
+
+// claimValues 返回以 "." 分隔的路径对应的声明取值，取值可以是字符串或字符串数组
+func claimValues(claims map[string]any, claimPath string) []string {
+	var value any = claims
+	for _, part := range strings.Split(claimPath, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = object[part]
+	}
+	switch v := value.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// isJWT 判断令牌是否具有 JWT 的格式
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// jwksCache 缓存从 JWKS 加载的公钥
+type jwksCache struct {
+	url  string
+	file string
+	ttl  time.Duration
+
+	group     singleflight.Group // 合并并发的刷新，拉取期间不持有 mu
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// key 返回给定 kid 对应的公钥，缓存过期或找不到 kid 时重新加载 JWKS
+// 令牌没有 kid 且 JWKS 中只有一个密钥时使用该密钥
+func (c *jwksCache) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	keys := c.keys
+	age := time.Since(c.fetchedAt)
+	c.mu.Unlock()
+
+	_, known := keys[kid]
+	if keys == nil || age > c.ttl || (!known && age > jwksMinRefreshWait) {
+		var err error
+		if keys, err = c.refresh(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// refresh 重新加载 JWKS 并返回当前的密钥，同一时间只有一次加载，其他请求等待它的结果
+// 加载失败时继续使用缓存的密钥
+func (c *jwksCache) refresh(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	value, err, _ := c.group.Do("jwks", func() (any, error) {
+		// 加载结果由所有等待的请求共享，不能因为发起加载的请求被取消而失败
+		keys, err := c.load(context.WithoutCancel(ctx))
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.fetchedAt = time.Now()
+		if err != nil {
+			if c.keys == nil {
+				return nil, fmt.Errorf("failed to load JWKS: %w", err)
+			}
+			log.Printf("Failed to refresh JWKS, using cached keys: %v", err)
+			return c.keys, nil
+		}
+		c.keys = keys
+		return keys, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(map[string]crypto.PublicKey), nil
+}
+
+// load 从 URL 或本地文件加载 JWKS
+func (c *jwksCache) load(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var data []byte
+	var err error
+	if c.file != "" {
+		data, err = os.ReadFile(c.file)
+	} else {
+		data, err = fetchJWKS(ctx, c.url)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+// fetchJWKS 通过 HTTP 获取 JWKS
+func fetchJWKS(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// jsonWebKey 是 JWKS 中的一个密钥，只包含校验签名需要的字段
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS 解析 JWKS 中用于签名的 RSA、EC 和 Ed25519 公钥，不支持的密钥会被跳过
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("Skipping JWKS key %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable keys in JWKS")
+	}
+	return keys, nil
+}
+
+// publicKey 把 JWK 转换为公钥
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestClaimValues(t *testing.T) {
+	claims := map[string]any{
+		"scope":  "read write",
+		"groups": []any{"admin", 42, "dev"},
+		"realm_access": map[string]any{
+			"roles": []any{"ops"},
+		},
+	}
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"scope", []string{"read", "write"}},
+		{"groups", []string{"admin", "dev"}},
+		{"realm_access.roles", []string{"ops"}},
+		{"realm_access.missing", nil},
+		{"scope.nested", nil},
+		{"missing", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := claimValues(claims, tt.path); !slices.Equal(got, tt.want) {
+				t.Errorf("claimValues(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdentityFromClaims(t *testing.T) {
+	tests := []struct {
+		name       string
+		claims     map[string]any
+		mapping    map[string][]string
+		wantServer map[string]bool
+		wantTool   map[[2]string]bool
+	}{
+		{
+			name:       "no mapping denies",
+			claims:     map[string]any{"groups": []any{"dev"}},
+			wantServer: map[string]bool{"github": false},
+		},
+		{
+			name:       "unmatched value denies",
+			claims:     map[string]any{"groups": []any{"guest"}},
+			mapping:    map[string][]string{"dev": {"github"}},
+			wantServer: map[string]bool{"github": false},
+		},
+		{
+			name:       "matched values are merged",
+			claims:     map[string]any{"groups": []any{"dev", "ops"}},
+			mapping:    map[string][]string{"dev": {"github:list_*"}, "ops": {"fetch"}},
+			wantServer: map[string]bool{"github": true, "fetch": true, "amap": false},
+			wantTool: map[[2]string]bool{
+				{"github", "list_issues"}:  true,
+				{"github", "create_issue"}: false,
+				{"fetch", "fetch"}:         true,
+			},
+		},
+		{
+			name:       "wildcard key applies to every token",
+			claims:     map[string]any{},
+			mapping:    map[string][]string{"*": {"fetch"}},
+			wantServer: map[string]bool{"fetch": true, "github": false},
+		},
+		{
+			name:       "claim value * does not select the wildcard key twice",
+			claims:     map[string]any{"groups": "*"},
+			mapping:    map[string][]string{"*": {"fetch"}},
+			wantServer: map[string]bool{"fetch": true, "github": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity := identityFromClaims("token", tt.claims, "groups", tt.mapping)
+			for server, want := range tt.wantServer {
+				if got := identity.allowsServer(server); got != want {
+					t.Errorf("allowsServer(%q) = %v, want %v", server, got, want)
+				}
+			}
+			for target, want := range tt.wantTool {
+				if got := identity.allowsTool(target[0], target[1]); got != want {
+					t.Errorf("allowsTool(%q, %q) = %v, want %v", target[0], target[1], got, want)
+				}
+			}
+		})
+	}
+}
+
+func encodeBase64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestParseJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaJWK := map[string]any{"kid": "rsa", "kty": "RSA", "n": encodeBase64(rsaKey.N.Bytes()), "e": encodeBase64(big.NewInt(int64(rsaKey.E)).Bytes())}
+	ecJWK := map[string]any{"kid": "ec", "kty": "EC", "crv": "P-256", "x": encodeBase64(ecKey.X.Bytes()), "y": encodeBase64(ecKey.Y.Bytes())}
+	edJWK := map[string]any{"kid": "ed", "kty": "OKP", "crv": "Ed25519", "x": encodeBase64(edKey)}
+
+	tests := []struct {
+		name     string
+		keys     []map[string]any
+		wantKids []string
+		wantErr  bool
+	}{
+		{"all key types", []map[string]any{rsaJWK, ecJWK, edJWK}, []string{"ec", "ed", "rsa"}, false},
+		{"encryption keys skipped", []map[string]any{rsaJWK, {"kid": "enc", "kty": "RSA", "use": "enc", "n": "AQAB", "e": "AQAB"}}, []string{"rsa"}, false},
+		{"unsupported keys skipped", []map[string]any{edJWK, {"kid": "oct", "kty": "oct"}, {"kid": "x448", "kty": "OKP", "crv": "X448"}}, []string{"ed"}, false},
+		{"no usable keys", []map[string]any{{"kid": "oct", "kty": "oct"}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(map[string]any{"keys": tt.keys})
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, err := parseJWKS(data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseJWKS error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var kids []string
+			for kid := range keys {
+				kids = append(kids, kid)
+			}
+			slices.Sort(kids)
+			if !slices.Equal(kids, tt.wantKids) {
+				t.Errorf("kids = %q, want %q", kids, tt.wantKids)
+			}
+		})
+	}
+}
+
+// writeJWKS 把 Ed25519 公钥写入临时的 JWKS 文件
+func writeJWKS(t *testing.T, kid string, key ed25519.PublicKey) string {
+	t.Helper()
+	data, err := json.Marshal(map[string]any{"keys": []any{map[string]any{"kid": kid, "kty": "OKP", "crv": "Ed25519", "x": encodeBase64(key)}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err = os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestJWTVerify(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := newJWTVerifier(&JWTConfig{
+		JWKSFile: writeJWKS(t, "k1", public),
+		CacheTTL: Duration(time.Minute),
+		Issuer:   "https://issuer.example.com",
+		Audience: "mcp-proxy",
+		Claim:    "groups",
+		Scopes:   map[string][]string{"dev": {"github"}},
+	})
+	sign := func(kid string, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		raw, err := token.SignedString(private)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":    "https://issuer.example.com",
+			"aud":    "mcp-proxy",
+			"sub":    "alice",
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"groups": []string{"dev"},
+		}
+	}
+	with := func(key string, value any) jwt.MapClaims {
+		claims := valid()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"valid", sign("k1", valid()), false},
+		{"single key without kid", sign("", valid()), false},
+		{"unknown kid", sign("k2", valid()), true},
+		{"expired", sign("k1", with("exp", time.Now().Add(-time.Hour).Unix())), true},
+		{"missing exp", sign("k1", with("exp", nil)), true},
+		{"wrong issuer", sign("k1", with("iss", "https://other.example.com")), true},
+		{"wrong audience", sign("k1", with("aud", "other")), true},
+		{"tampered", sign("k1", valid()) + "x", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := verifier.verify(context.Background(), tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verify error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if identity.Subject != "alice" {
+				t.Errorf("Subject = %q, want alice", identity.Subject)
+			}
+			if !identity.allowsServer("github") || identity.allowsServer("fetch") {
+				t.Errorf("scopes = %v, want only github", identity.scopes)
+			}
+		})
+	}
+}
+
+func TestJWKSCacheSharesConcurrentFetches(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(writeJWKS(t, "k1", public))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		_, _ = w.Write(data)
+	}))
+	defer srv.Close()
+
+	cache := &jwksCache{url: srv.URL, ttl: time.Minute}
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cache.key(context.Background(), "k1")
+			errs <- err
+		}()
+	}
+	// 拉取期间缓存的锁不能被持有
+	time.Sleep(50 * time.Millisecond)
+	if !cache.mu.TryLock() {
+		t.Fatal("cache lock is held during the fetch")
+	}
+	cache.mu.Unlock()
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("key() = %v", err)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("fetches = %d, want 1", n)
+	}
+}
@@ -0,0 +1,301 @@
+// lazy.go 文件实现了 stdio 后端的按需启动。
+// 按需启动的后端在代理启动时不会常驻运行：能力列表来自上一次运行时缓存的文件，没有缓存时启动一次进程获取后立即停止；
+// 收到第一个调用时才由监督任务启动进程，空闲超过一段时间后再次停止，进程退出后也会等到下一次调用时再启动。
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// lazyStart 记录按需启动的后端的启动请求和使用情况
+type lazyStart struct {
+	catalogFile string        // 缓存能力列表的文件，未配置时不缓存
+	idleTimeout time.Duration // 进程的空闲超时时间
+	wake        chan struct{} // 通知监督任务启动进程
+
+	mu       sync.Mutex
+	attempt  *startAttempt // 正在进行或等待监督任务处理的启动
+	inflight int           // 进行中的调用数量
+	lastUsed time.Time     // 最近一次调用结束的时间
+}
+
+// startAttempt 是一次按需启动，完成后 done 会被关闭
+type startAttempt struct {
+	done chan struct{}
+	err  error
+}
+
+// newLazyStart 根据配置创建按需启动，未启用时返回 nil
+func newLazyStart(conf *StdioMCPClientConfig) *lazyStart {
+	if !conf.Lazy {
+		return nil
+	}
+	return &lazyStart{
+		catalogFile: conf.CatalogFile,
+		idleTimeout: conf.IdleTimeout,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// request 请求监督任务启动进程，已经有启动在进行时返回同一个启动
+func (l *lazyStart) request() *startAttempt {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.attempt == nil {
+		l.attempt = &startAttempt{done: make(chan struct{})}
+		select {
+		case l.wake <- struct{}{}:
+		default:
+		}
+	}
+	return l.attempt
+}
+
+// begin 返回监督任务需要处理的启动，没有等待的启动时返回 nil
+func (l *lazyStart) begin() *startAttempt {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.attempt
+}
+
+// finish 结束一次启动并通知等待的调用，之后的调用会发起新的启动
+func (l *lazyStart) finish(attempt *startAttempt, err error) {
+	l.mu.Lock()
+	if l.attempt == attempt {
+		l.attempt = nil
+	}
+	l.mu.Unlock()
+	attempt.err = err
+	close(attempt.done)
+}
+
+// abort 在监督任务退出时结束等待中的启动，避免调用一直等待下去
+func (l *lazyStart) abort(err error) {
+	if attempt := l.begin(); attempt != nil {
+		l.finish(attempt, err)
+	}
+}
+
+// acquire 记录一次调用开始，进行中的调用会阻止进程因空闲而停止
+func (l *lazyStart) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight++
+}
+
+// release 记录一次调用结束，并开始计算空闲时间
+func (l *lazyStart) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	l.lastUsed = time.Now()
+}
+
+// remainingLocked 返回距离空闲超时还剩的时间，有进行中的调用时返回完整的超时时间，调用方需要持有 l.mu
+func (l *lazyStart) remainingLocked() time.Duration {
+	if l.inflight > 0 {
+		return l.idleTimeout
+	}
+	return l.idleTimeout - time.Since(l.lastUsed)
+}
+
+// cachedCatalog 是缓存到文件中的能力列表
+type cachedCatalog struct {
+	Tools             []mcp.Tool             `json:"tools"`
+	Prompts           []mcp.Prompt           `json:"prompts"`
+	Resources         []mcp.Resource         `json:"resources"`
+	ResourceTemplates []mcp.ResourceTemplate `json:"resourceTemplates"`
+	Logging           bool                   `json:"logging,omitempty"`
+}
+
+// load 读取缓存的能力列表，未配置缓存文件或文件不存在时返回 nil
+func (l *lazyStart) load() (*catalog, error) {
+	if l.catalogFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(l.catalogFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cached cachedCatalog
+	if err = json.Unmarshal(data, &cached); err != nil {
+		return nil, fmt.Errorf("invalid catalog file %s: %w", l.catalogFile, err)
+	}
+	return &catalog{
+		tools:             cached.Tools,
+		prompts:           cached.Prompts,
+		resources:         cached.Resources,
+		resourceTemplates: cached.ResourceTemplates,
+		logging:           cached.Logging,
+	}, nil
+}
+
+// save 把能力列表写入缓存文件，先写入临时文件再重命名，避免留下不完整的文件
+func (l *lazyStart) save(current *catalog) error {
+	if l.catalogFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(cachedCatalog{
+		Tools:             current.tools,
+		Prompts:           current.prompts,
+		Resources:         current.resources,
+		ResourceTemplates: current.resourceTemplates,
+		Logging:           current.logging,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(l.catalogFile), 0o755); err != nil {
+		return err
+	}
+	tmp := l.catalogFile + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.catalogFile)
+}
+
+// loadCatalog 加载缓存的能力列表并同步到所有注册表
+// 缓存可能是在工具过滤配置变化之前写入的，这里重新应用当前的过滤配置
+func (c *Client) loadCatalog() {
+	cached, err := c.lazy.load()
+	if err != nil {
+		log.Printf("<%s> Failed to load cached catalog, discovering: %v", c.name, err)
+		return
+	}
+	if cached == nil {
+		return
+	}
+	filterFunc := c.toolFilter()
+	tools := make([]mcp.Tool, 0, len(cached.tools))
+	for _, tool := range cached.tools {
+		if filterFunc(tool.Name) {
+			tools = append(tools, tool)
+		}
+	}
+	cached.tools = tools
+	c.mu.Lock()
+	c.catalog = cached
+	c.mu.Unlock()
+	log.Printf("<%s> Loaded %d cached tools, starting on first call", c.name, len(tools))
+	c.syncRegistries()
+}
+
+// sharedClient 返回共享的底层客户端，并返回调用结束后需要调用的 release 函数
+// 按需启动的后端没有运行时，请求监督任务启动进程并等待启动完成
+func (c *Client) sharedClient(ctx context.Context) (*client.Client, func(), error) {
+	if c.lazy == nil {
+		mcpClient, err := c.currentClient()
+		return mcpClient, func() {}, err
+	}
+	c.lazy.acquire()
+	for {
+		c.mu.RLock()
+		state, mcpClient := c.state, c.client
+		c.mu.RUnlock()
+		if state == ClientStateReady && mcpClient != nil {
+			return mcpClient, c.lazy.release, nil
+		}
+		if state != ClientStateIdle {
+			c.lazy.release()
+			return nil, nil, fmt.Errorf("backend %s is %s", c.name, state)
+		}
+		attempt := c.lazy.request()
+		select {
+		case <-attempt.done:
+		case <-ctx.Done():
+			c.lazy.release()
+			return nil, nil, ctx.Err()
+		}
+		if attempt.err != nil {
+			c.lazy.release()
+			return nil, nil, fmt.Errorf("failed to start backend %s: %w", c.name, attempt.err)
+		}
+	}
+}
+
+// wakeUp 等待调用请求启动进程，然后连接后端并通知等待的调用
+// 启动失败时后端仍处于空闲状态，下一次调用会再次尝试；返回 false 表示监督任务应当退出
+func (c *Client) wakeUp(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		log.Printf("<%s> Context done, stopping supervisor", c.name)
+		return false
+	case <-c.lazy.wake:
+	}
+	attempt := c.lazy.begin()
+	if attempt == nil {
+		return true
+	}
+	log.Printf("<%s> Starting on demand", c.name)
+	err := c.connect(ctx)
+	if err != nil {
+		log.Printf("<%s> Failed to start on demand: %v", c.name, err)
+		c.mu.Lock()
+		c.lastErr = err
+		c.mu.Unlock()
+	}
+	c.lazy.finish(attempt, err)
+	return true
+}
+
+// sleep 停止进程并进入空闲状态，下一次调用时重新启动
+func (c *Client) sleep(cause error) {
+	mcpClient, cmd := c.suspend(cause)
+	if mcpClient != nil {
+		_ = closeMCPClient(mcpClient, cmd, c.killTimeout)
+	}
+}
+
+// sleepIfIdle 在进程空闲超时后停止它，返回下一次检查前需要等待的时间
+func (c *Client) sleepIfIdle() time.Duration {
+	// 有下游会话订阅资源时保持运行，否则停止进程后不会再收到资源更新通知
+	if c.hasSubscriptions() {
+		return c.lazy.idleTimeout
+	}
+	c.lazy.mu.Lock()
+	if remaining := c.lazy.remainingLocked(); remaining > 0 {
+		c.lazy.mu.Unlock()
+		return remaining
+	}
+	// 持有 lazy.mu 时切换到空闲状态，之后开始的调用会等待进程重新启动，而不会拿到正在关闭的客户端
+	mcpClient, cmd := c.suspend(nil)
+	c.lazy.mu.Unlock()
+	log.Printf("<%s> Idle for %s, stopping until the next call", c.name, c.lazy.idleTimeout)
+	if mcpClient != nil {
+		_ = closeMCPClient(mcpClient, cmd, c.killTimeout)
+	}
+	return c.lazy.idleTimeout
+}
+
+// suspend 把客户端切换到空闲状态，并返回需要关闭的底层客户端
+func (c *Client) suspend(cause error) (*client.Client, *exec.Cmd) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	mcpClient, cmd := c.client, c.cmd
+	c.client, c.cmd = nil, nil
+	c.state = ClientStateIdle
+	c.lastErr = cause
+	return mcpClient, cmd
+}
+
+// isIdle 判断按需启动的后端当前是否没有运行
+func (c *Client) isIdle() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.state == ClientStateIdle
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+func TestLazyStartAttempts(t *testing.T) {
+	l := newLazyStart(&StdioMCPClientConfig{Lazy: true, IdleTimeout: time.Minute})
+	first := l.request()
+	if second := l.request(); second != first {
+		t.Fatal("concurrent calls started separate attempts")
+	}
+	if len(l.wake) != 1 {
+		t.Fatalf("wake signals = %d, want 1", len(l.wake))
+	}
+	if l.begin() != first {
+		t.Fatal("begin did not return the pending attempt")
+	}
+	l.finish(first, nil)
+	select {
+	case <-first.done:
+	default:
+		t.Fatal("finish did not release waiting calls")
+	}
+	if l.begin() != nil {
+		t.Fatal("finished attempt is still pending")
+	}
+
+	next := l.request()
+	if next == first {
+		t.Fatal("call after a finished attempt reused it")
+	}
+	cause := errors.New("supervisor stopped")
+	l.abort(cause)
+	<-next.done
+	if next.err != cause {
+		t.Errorf("aborted attempt err = %v, want %v", next.err, cause)
+	}
+}
+
+func TestLazyStartRemaining(t *testing.T) {
+	tests := []struct {
+		name     string
+		inflight int
+		lastUsed time.Duration
+		wantIdle bool
+	}{
+		{name: "call in flight", inflight: 1, lastUsed: -time.Hour},
+		{name: "recently used", lastUsed: -time.Second},
+		{name: "idle timeout passed", lastUsed: -2 * time.Minute, wantIdle: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &lazyStart{idleTimeout: time.Minute, inflight: tt.inflight, lastUsed: time.Now().Add(tt.lastUsed)}
+			if got := l.remainingLocked() <= 0; got != tt.wantIdle {
+				t.Errorf("remaining = %s, want idle %v", l.remainingLocked(), tt.wantIdle)
+			}
+		})
+	}
+}
+
+func TestSleepIfIdle(t *testing.T) {
+	tests := []struct {
+		name        string
+		subscribed  bool
+		lastUsed    time.Duration
+		wantStopped bool
+	}{
+		{name: "idle", lastUsed: -2 * time.Minute, wantStopped: true},
+		{name: "recently used", lastUsed: -time.Second},
+		{name: "subscribed resources keep it running", subscribed: true, lastUsed: -2 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{name: "a", state: ClientStateReady, lazy: &lazyStart{idleTimeout: time.Minute, lastUsed: time.Now().Add(tt.lastUsed)}}
+			if tt.subscribed {
+				c.subscribers = map[string][]subscriber{"file:///a": {{sessionID: "s1"}}}
+			}
+			wait := c.sleepIfIdle()
+			if wait <= 0 || wait > time.Minute {
+				t.Errorf("next check in %s, want within the idle timeout", wait)
+			}
+			if c.isIdle() != tt.wantStopped {
+				t.Errorf("idle = %v, want %v", c.isIdle(), tt.wantStopped)
+			}
+		})
+	}
+}
+
+func TestCatalogCache(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalid, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		file    string
+		save    *catalog
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "no cache file configured", wantNil: true},
+		{name: "missing file", file: filepath.Join(dir, "missing.json"), wantNil: true},
+		{name: "invalid file", file: invalid, wantErr: true},
+		{
+			name: "round trip",
+			file: filepath.Join(dir, "nested", "catalog.json"),
+			save: &catalog{
+				tools:     []mcp.Tool{mcp.NewTool("search")},
+				prompts:   []mcp.Prompt{mcp.NewPrompt("p")},
+				resources: []mcp.Resource{mcp.NewResource("file:///a", "a")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &lazyStart{catalogFile: tt.file}
+			if tt.save != nil {
+				if err := l.save(tt.save); err != nil {
+					t.Fatal(err)
+				}
+			}
+			loaded, err := l.load()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("load error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr || tt.wantNil {
+				if loaded != nil {
+					t.Errorf("load = %+v, want nil", loaded)
+				}
+				return
+			}
+			if len(loaded.tools) != 1 || loaded.tools[0].Name != "search" ||
+				len(loaded.prompts) != 1 || loaded.prompts[0].Name != "p" ||
+				len(loaded.resources) != 1 || loaded.resources[0].URI != "file:///a" {
+				t.Errorf("load = %+v, want %+v", loaded, tt.save)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+// logging.go 文件实现了后端日志消息的转发。
+// 下游会话发送的 logging/setLevel 会被记录下来并转发给后端：共享的连接使用所有会话中最详细的级别，
+// 按下游会话建立的连接使用该会话的级别；后端发送的 notifications/message 只会转发给设置过日志级别的会话，
+// 再由代理的 MCP 服务器按各会话的级别过滤。聚合路由上日志的 logger 会加上后端的命名空间前缀。
+// 只有路由上有后端声明了日志能力或开启了 mirrorLogs 时，路由才会向下游声明日志能力并接受 logging/setLevel。
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// setLevelTimeout 是向后端转发日志级别的超时时间
+const setLevelTimeout = 10 * time.Second
+
+// methodNotificationMessage 是日志消息通知的方法名称，mcp-go 没有为它定义常量
+const methodNotificationMessage = "notifications/message"
+
+// errLoggingDisabled 是路由没有提供日志能力时 logging/setLevel 的错误
+var errLoggingDisabled = errors.New("logging is not supported by the servers on this route")
+
+// loggingEnabled 判断路由是否提供日志能力：路由上有后端声明了日志能力，或者有后端开启了 mirrorLogs
+// 按需启动的后端空闲时使用上一次运行时缓存的能力
+func (s *Server) loggingEnabled() bool {
+	if s.backends == nil {
+		return false
+	}
+	for _, c := range s.backends() {
+		if c.snapshot().logging {
+			return true
+		}
+		if options := c.currentOptions(); options != nil && options.MirrorLogs.OrElse(false) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSetLevel 在路由没有提供日志能力时拒绝 logging/setLevel 请求，其他请求直接返回
+func (s *Server) checkSetLevel(message any) error {
+	raw, ok := message.(json.RawMessage)
+	if !ok || !bytes.Contains(raw, []byte(mcp.MethodSetLogLevel)) {
+		return nil
+	}
+	var request struct {
+		Method mcp.MCPMethod `json:"method"`
+	}
+	if err := json.Unmarshal(raw, &request); err != nil || request.Method != mcp.MethodSetLogLevel || s.loggingEnabled() {
+		return nil
+	}
+	return errLoggingDisabled
+}
+
+// setLogLevel 处理下游会话的 logging/setLevel，把级别转发给路由上的所有后端
+func (s *Server) setLogLevel(ctx context.Context, level mcp.LoggingLevel) {
+	session := server.ClientSessionFromContext(ctx)
+	if session == nil || s.backends == nil {
+		return
+	}
+	sub := subscriber{server: s.mcpServer, sessionID: session.SessionID()}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), setLevelTimeout)
+	defer cancel()
+	for _, c := range s.backends() {
+		c.setLogLevel(ctx, sub, level)
+	}
+}
+
+// closeLogLevels 在下游会话结束时移除它在路由上的所有后端设置的日志级别
+func (s *Server) closeLogLevels(sessionID string) {
+	if s.backends == nil {
+		return
+	}
+	sub := subscriber{server: s.mcpServer, sessionID: sessionID}
+	for _, c := range s.backends() {
+		c.removeLogLevel(sub)
+	}
+}
+
+// setLogLevel 记录下游会话设置的日志级别，并更新共享连接和该会话专属连接上的级别
+// 后端当前没有连接时只记录级别，连接建立后再设置
+func (c *Client) setLogLevel(ctx context.Context, sub subscriber, level mcp.LoggingLevel) {
+	c.logMu.Lock()
+	defer c.logMu.Unlock()
+	c.mu.Lock()
+	if c.logLevels == nil {
+		c.logLevels = make(map[subscriber]mcp.LoggingLevel)
+	}
+	c.logLevels[sub] = level
+	mcpClient := c.client
+	c.mu.Unlock()
+	if mcpClient != nil {
+		c.updateLogLevel(ctx, mcpClient)
+	}
+	if c.sessions != nil {
+		if sessionClient := c.sessions.lookup(sub.sessionID); sessionClient != nil {
+			c.sendLogLevel(ctx, sessionClient, level)
+		}
+	}
+}
+
+// removeLogLevel 移除下游会话设置的日志级别，后端保持当前的级别，不再有会话接收的日志会被丢弃
+func (c *Client) removeLogLevel(sub subscriber) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.logLevels, sub)
+}
+
+// restoreLogLevel 在重连后把共享连接的日志级别恢复为下游会话设置的级别
+func (c *Client) restoreLogLevel(mcpClient *client.Client) {
+	c.logMu.Lock()
+	defer c.logMu.Unlock()
+	ctx, cancel := context.WithTimeout(c.ctx, setLevelTimeout)
+	defer cancel()
+	c.updateLogLevel(ctx, mcpClient)
+}
+
+// updateLogLevel 把共享连接的日志级别设置为所有下游会话中最详细的级别，级别没有变化时不发送，调用方需要持有 c.logMu
+func (c *Client) updateLogLevel(ctx context.Context, mcpClient *client.Client) {
+	c.mu.RLock()
+	var level mcp.LoggingLevel
+	for _, l := range c.logLevels {
+		if level == "" || level.ShouldSendTo(l) {
+			level = l
+		}
+	}
+	unchanged := level == "" || level == c.logLevel
+	c.mu.RUnlock()
+	if unchanged || !c.sendLogLevel(ctx, mcpClient, level) {
+		return
+	}
+	c.mu.Lock()
+	if c.client == mcpClient {
+		c.logLevel = level
+	}
+	c.mu.Unlock()
+}
+
+// sessionLogLevel 返回下游会话设置的日志级别，没有设置时返回空字符串
+func (c *Client) sessionLogLevel(sessionID string) mcp.LoggingLevel {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for sub, level := range c.logLevels {
+		if sub.sessionID == sessionID {
+			return level
+		}
+	}
+	return ""
+}
+
+// sendLogLevel 在后端声明了日志能力时设置底层客户端的日志级别，返回是否设置成功
+func (c *Client) sendLogLevel(ctx context.Context, mcpClient *client.Client, level mcp.LoggingLevel) bool {
+	if mcpClient.GetServerCapabilities().Logging == nil {
+		return false
+	}
+	if err := mcpClient.SetLevel(ctx, mcp.SetLevelRequest{Params: mcp.SetLevelParams{Level: level}}); err != nil {
+		log.Printf("<%s> Failed to set log level to %s: %v", c.name, level, err)
+		return false
+	}
+	log.Printf("<%s> Set log level to %s", c.name, level)
+	return true
+}
+
+// forwardLog 把后端的日志消息转发给设置过日志级别的下游会话
+// 共享连接的日志发送给所有这样的会话，会话专属连接的日志只发送给该会话，已被替换的共享连接的日志会被丢弃
+func (c *Client) forwardLog(mcpClient *client.Client, notification mcp.JSONRPCNotification) {
+	level, _ := notification.Params.AdditionalFields["level"].(string)
+	logger, _ := notification.Params.AdditionalFields["logger"].(string)
+	data := notification.Params.AdditionalFields["data"]
+
+	c.mu.RLock()
+	current := c.client == mcpClient
+	registries := slices.Clone(c.registries)
+	subscribers := make([]subscriber, 0, len(c.logLevels))
+	for sub := range c.logLevels {
+		subscribers = append(subscribers, sub)
+	}
+	c.mu.RUnlock()
+	sessionID := ""
+	if !current {
+		var ok bool
+		if sessionID, ok = c.sessions.sessionOf(mcpClient); !ok {
+			return
+		}
+	}
+
+	if options := c.currentOptions(); options != nil && options.MirrorLogs.OrElse(false) {
+		log.Printf("<%s> [%s] %s", c.name, level, formatLogMessage(logger, data))
+	}
+	for _, sub := range subscribers {
+		if sessionID != "" && sub.sessionID != sessionID {
+			continue
+		}
+		message := mcp.NewLoggingMessageNotification(mcp.LoggingLevel(level), c.tagLogger(registries, sub.server, logger), data)
+		if err := sub.server.SendLogMessageToSpecificClient(sub.sessionID, message); err != nil {
+			log.Printf("<%s> Failed to forward %s to session %s: %v", c.name, notification.Method, sub.sessionID, err)
+		}
+	}
+}
+
+// tagLogger 返回日志在 MCP 服务器上使用的 logger 名称，聚合路由上加上后端的命名空间前缀，没有 logger 时使用命名空间
+func (c *Client) tagLogger(registries []*registry, mcpServer *server.MCPServer, logger string) string {
+	for _, reg := range registries {
+		if reg.mcpServer != mcpServer || reg.separator == "" {
+			continue
+		}
+		if logger == "" {
+			return c.namespace()
+		}
+		return reg.qualify(c, logger)
+	}
+	return logger
+}
+
+// formatLogMessage 把日志消息格式化为一行文本，非字符串的数据按 JSON 输出
+func formatLogMessage(logger string, data any) string {
+	text, ok := data.(string)
+	if !ok {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			encoded = []byte(fmt.Sprint(data))
+		}
+		text = string(encoded)
+	}
+	if logger == "" {
+		return text
+	}
+	return logger + ": " + text
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/TBXark/optional-go"
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+func TestLoggingEnabled(t *testing.T) {
+	mirror := &Options{MirrorLogs: optional.NewField(true)}
+	tests := []struct {
+		name     string
+		backends []*Client
+		want     bool
+	}{
+		{name: "no backends"},
+		{name: "backend without logging", backends: []*Client{{catalog: &catalog{}}}},
+		{name: "backend advertises logging", backends: []*Client{{}, {catalog: &catalog{logging: true}}}, want: true},
+		{name: "mirrorLogs configured", backends: []*Client{{options: mirror}}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newMCPServer("a", "1", "http://localhost", &Options{Transports: []MCPServerType{MCPServerTypeStreamable}})
+			s.backends = func() []*Client {
+				return tt.backends
+			}
+			if got := s.loggingEnabled(); got != tt.want {
+				t.Errorf("loggingEnabled = %v, want %v", got, tt.want)
+			}
+
+			initialize := `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"protocolVersion":"2025-06-18","capabilities":{},"clientInfo":{"name":"t","version":"1"}}}`
+			response, ok := s.mcpServer.HandleMessage(context.Background(), json.RawMessage(initialize)).(mcp.JSONRPCResponse)
+			if !ok {
+				t.Fatalf("initialize failed: %+v", response)
+			}
+			result, _ := response.Result.(mcp.InitializeResult)
+			if got := result.Capabilities.Logging != nil; got != tt.want {
+				t.Errorf("advertised logging = %v, want %v", got, tt.want)
+			}
+
+			setLevel := json.RawMessage(`{"jsonrpc":"2.0","id":2,"method":"logging/setLevel","params":{"level":"info"}}`)
+			if err := s.checkSetLevel(setLevel); (err == nil) != tt.want || (err != nil && !errors.Is(err, errLoggingDisabled)) {
+				t.Errorf("checkSetLevel = %v, want allowed %v", err, tt.want)
+			}
+			if err := s.checkSetLevel(json.RawMessage(`{"jsonrpc":"2.0","id":3,"method":"ping"}`)); err != nil {
+				t.Errorf("checkSetLevel(ping) = %v", err)
+			}
+		})
+	}
+}
+
+func TestSetLevelRejectedWithoutLogging(t *testing.T) {
+	s := newMCPServer("a", "1", "http://localhost", &Options{Transports: []MCPServerType{MCPServerTypeStreamable}})
+	s.backends = func() []*Client {
+		return []*Client{{catalog: &catalog{}}}
+	}
+	session := &testSession{id: "s1", notifications: make(chan mcp.JSONRPCNotification, 1)}
+	ctx := s.mcpServer.WithContext(context.Background(), session)
+	message := json.RawMessage(`{"jsonrpc":"2.0","id":2,"method":"logging/setLevel","params":{"level":"info"}}`)
+	response, ok := s.mcpServer.HandleMessage(ctx, message).(mcp.JSONRPCError)
+	if !ok {
+		t.Fatalf("logging/setLevel = %+v, want an error", response)
+	}
+	if response.Error.Message != errLoggingDisabled.Error() {
+		t.Errorf("error = %q, want %q", response.Error.Message, errLoggingDisabled)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 )
 
 // BuildVersion 存储应用程序的当前版本
@@ -14,10 +15,31 @@ var BuildVersion = "dev"
 
 // main 函数是程序的入口点
 func main() {
+	// 作为 stdio 后端的启动器运行时，设置资源限制后执行后端的命令，不会返回
+	if len(os.Args) > 1 && os.Args[1] == sandboxCommand {
+		runSandbox(os.Args[2:])
+	}
+	// 子命令：检查配置文件，或输出配置文件的 JSON Schema
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(runValidate(os.Args[2:]))
+		case "schema":
+			os.Exit(runSchema())
+		}
+	}
+
+	// 从日志输出中隐去配置中引用的环境变量和文件的值
+	log.SetOutput(logRedactor.writer(os.Stderr))
+
 	// 定义并解析命令行参数
 	conf := flag.String("config", "config.json", "path to config file or a http(s) url")
 	version := flag.Bool("version", false, "print version and exit")
 	help := flag.Bool("help", false, "print help and exit")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n  %[1]s [flags]\n  %[1]s validate [--config path]\n  %[1]s schema\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	// 如果用户请求帮助信息，则显示所有可用的命令行参数
@@ -40,7 +62,7 @@ func main() {
 
 	// 使用加载的配置启动HTTP服务器
 	// 这个函数会阻塞直到服务器关闭或发生错误
-	err = startHTTPServer(config)
+	err = startHTTPServer(*conf, config)
 	if err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
@@ -0,0 +1,146 @@
+// metrics.go 文件定义了代理导出的 Prometheus 指标。
+// 指标总是会被采集，只有配置了 mcpProxy.metrics 时才会通过 HTTP 暴露。
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mcp_proxy_http_requests_total",
+		Help: "HTTP requests handled per route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mcp_proxy_http_request_duration_seconds",
+		Help:    "Duration of HTTP requests per route, excluding SSE streams.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	activeStreamConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mcp_proxy_active_stream_connections",
+		Help: "Open SSE and Streamable HTTP GET streams per route and transport.",
+	}, []string{"route", "transport"})
+	toolCallsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mcp_proxy_tool_calls_total",
+		Help: "Tool calls forwarded per backend and tool, by result (success or error).",
+	}, []string{"backend", "tool", "result"})
+	backendCallDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mcp_proxy_backend_call_duration_seconds",
+		Help:    "Latency of calls forwarded to backends per backend and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend", "method"})
+	pingFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mcp_proxy_backend_ping_failures_total",
+		Help: "Failed pings per backend.",
+	}, []string{"backend"})
+	reconnectsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mcp_proxy_backend_reconnects_total",
+		Help: "Reconnect attempts per backend, by result (success or error).",
+	}, []string{"backend", "result"})
+	stdioRestartsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mcp_proxy_stdio_restarts_total",
+		Help: "Stdio backend processes started again after the first start.",
+	}, []string{"backend"})
+)
+
+// resultLabel 把错误转换为指标的 result 标签
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// statusRecorder 记录响应状态码，同时保留 http.Flusher，SSE 和 Streamable HTTP 都依赖它
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader 记录状态码并写入响应头
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write 在没有显式写入响应头时记录默认的 200 状态码
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush 实现了 http.Flusher 接口
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap 返回原始的 ResponseWriter，供 http.ResponseController 使用
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// metricsMiddleware 创建一个中间件，按路由统计请求数、请求耗时和打开的长连接。
+func metricsMiddleware(route string) MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			recorder := &statusRecorder{ResponseWriter: w}
+			// GET 请求在 SSE 和 Streamable HTTP 中都用于打开长连接，它们的耗时没有意义
+			stream := r.Method == http.MethodGet
+			if stream {
+				transport := MCPServerTypeStreamable
+				if strings.HasSuffix(r.URL.Path, "/sse") {
+					transport = MCPServerTypeSSE
+				}
+				activeStreamConnections.WithLabelValues(route, string(transport)).Inc()
+				defer activeStreamConnections.WithLabelValues(route, string(transport)).Dec()
+			}
+			start := time.Now()
+			next.ServeHTTP(recorder, r)
+			if !stream {
+				httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+			}
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+			httpRequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Inc()
+		})
+	}
+}
+
+// metricsHandler 返回暴露指标的 HTTP 处理器，配置了认证令牌时需要认证
+func metricsHandler(conf *MetricsConfig) http.Handler {
+	return chainMiddleware(promhttp.Handler(), newAuthMiddleware(conf.AuthTokens, nil, nil, nil))
+}
+
+// startMetricsServer 在独立的地址上暴露指标
+func startMetricsServer(conf *MetricsConfig) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(conf.Path, metricsHandler(conf))
+	metricsServer := &http.Server{
+		Addr:    conf.Addr,
+		Handler: mux,
+	}
+	go func() {
+		log.Printf("Metrics listening on %s%s", conf.Addr, conf.Path)
+		err := metricsServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start metrics server: %v", err)
+		}
+	}()
+	return metricsServer
+}
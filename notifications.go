@@ -0,0 +1,88 @@
+// notifications.go 文件处理后端发送给代理的通知。
+// 后端的工具、提示或资源列表变化时，代理重新获取能力列表并重新应用工具过滤，
+// 再同步到所有注册表，由代理的 MCP 服务器向已连接的下游会话发送相应的 list_changed 通知。
+// 能力列表只来自共享的底层客户端，按下游会话建立的连接只转发进度和日志通知。
+package main
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// resyncTimeout 是收到能力列表变化的通知后重新获取能力列表的超时时间
+const resyncTimeout = 30 * time.Second
+
+// handleNotification 处理底层客户端收到的通知，能力列表和资源更新的通知只处理当前仍在使用的底层客户端发送的
+// 通知由传输层的读取任务同步调用，这里不能等待后端的响应
+func (c *Client) handleNotification(mcpClient *client.Client, notification mcp.JSONRPCNotification) {
+	switch notification.Method {
+	case mcp.MethodNotificationToolsListChanged,
+		mcp.MethodNotificationPromptsListChanged,
+		mcp.MethodNotificationResourcesListChanged:
+		c.listChanged(mcpClient, notification.Method)
+	case mcp.MethodNotificationResourceUpdated:
+		c.resourceUpdated(mcpClient, notification)
+	case methodNotificationProgress:
+		c.forwardProgress(notification)
+	case methodNotificationMessage:
+		c.forwardLog(mcpClient, notification)
+	}
+}
+
+// listChanged 在后台重新获取能力列表，同一时间只有一次重新获取，期间收到的通知会合并为下一次重新获取
+func (c *Client) listChanged(mcpClient *client.Client, method string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != mcpClient {
+		return
+	}
+	log.Printf("<%s> Received %s", c.name, method)
+	if c.resyncing {
+		c.resyncPending = true
+		return
+	}
+	c.resyncing = true
+	go c.resync(mcpClient)
+}
+
+// resync 使用发送通知的底层客户端重新获取能力列表，列表确实发生变化时才同步到所有注册表
+// 底层客户端在此期间被替换时放弃结果，重连时会重新获取能力列表
+func (c *Client) resync(mcpClient *client.Client) {
+	for {
+		ctx, cancel := context.WithTimeout(c.ctx, resyncTimeout)
+		newCatalog, err := c.fetchCatalog(ctx, mcpClient)
+		cancel()
+
+		c.mu.Lock()
+		current := c.client == mcpClient
+		changed := err == nil && current && !reflect.DeepEqual(c.catalog, newCatalog)
+		if changed {
+			c.catalog = newCatalog
+		}
+		pending := current && c.resyncPending
+		c.resyncing = pending
+		c.resyncPending = false
+		c.mu.Unlock()
+
+		if err != nil && current {
+			log.Printf("<%s> Failed to re-list capabilities: %v", c.name, err)
+		}
+		if changed {
+			log.Printf("<%s> Capabilities changed, syncing", c.name)
+			if c.lazy != nil {
+				if err = c.lazy.save(newCatalog); err != nil {
+					log.Printf("<%s> Failed to cache catalog: %v", c.name, err)
+				}
+			}
+			c.syncRegistries()
+		}
+		if !pending {
+			return
+		}
+	}
+}
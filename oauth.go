@@ -0,0 +1,346 @@
+// oauth.go 文件实现了 MCP 授权规范中受保护资源的部分。
+// 代理为每个路由发布 RFC 9728 受保护资源元数据，认证失败时返回指向元数据的 WWW-Authenticate 质询，
+// 并转发授权服务器的 RFC 8414 元数据；访问令牌通过 JWT 或 RFC 7662 令牌内省校验。
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oauthResourceMetadataPath = "/.well-known/oauth-protected-resource"   // RFC 9728 受保护资源元数据的路径
+	oauthServerMetadataPath   = "/.well-known/oauth-authorization-server" // RFC 8414 授权服务器元数据的路径
+	oauthServerMetadataTTL    = 10 * time.Minute                          // 授权服务器元数据的缓存时间
+	introspectionTimeout      = 10 * time.Second                          // 调用内省端点的超时时间
+)
+
+// tokenVerifier 校验静态令牌之外的访问令牌，JWT 格式的令牌使用 JWT 校验，其余的令牌使用令牌内省
+type tokenVerifier struct {
+	jwt           *jwtVerifier  // 为 nil 时不接受 JWT
+	introspection *introspector // 为 nil 时不进行令牌内省
+}
+
+// newTokenVerifier 根据配置创建访问令牌校验器，两种方式都未配置时返回 nil
+func newTokenVerifier(jwtConfig *JWTConfig, oauth *OAuthConfig) *tokenVerifier {
+	v := &tokenVerifier{jwt: newJWTVerifier(jwtConfig)}
+	if oauth != nil && oauth.Introspection != nil {
+		v.introspection = &introspector{
+			conf:  oauth.Introspection,
+			cache: make(map[string]introspectionResult),
+		}
+	}
+	if v.jwt == nil && v.introspection == nil {
+		return nil
+	}
+	return v
+}
+
+// verify 校验访问令牌并返回对应的调用方身份
+func (v *tokenVerifier) verify(ctx context.Context, token string) (*Identity, error) {
+	if v.jwt != nil && isJWT(token) {
+		return v.jwt.verify(ctx, token)
+	}
+	if v.introspection != nil {
+		return v.introspection.verify(ctx, token)
+	}
+	return nil, errors.New("token is not a JWT")
+}
+
+// introspector 通过授权服务器的内省端点校验不透明的访问令牌，并缓存内省结果
+type introspector struct {
+	conf *IntrospectionConfig
+
+	mu    sync.Mutex
+	cache map[string]introspectionResult // 令牌的 SHA-256 -> 内省结果
+}
+
+// introspectionResult 是缓存的内省结果，令牌无效时 identity 为 nil
+type introspectionResult struct {
+	identity *Identity
+	err      error
+	expires  time.Time
+}
+
+// verify 返回令牌对应的调用方身份，缓存未命中时调用内省端点
+func (i *introspector) verify(ctx context.Context, token string) (*Identity, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	i.mu.Lock()
+	cached, ok := i.cache[key]
+	i.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.identity, cached.err
+	}
+
+	claims, err := i.introspect(ctx, token)
+	if err != nil {
+		// 内省端点不可用时不缓存，下一次请求会重试
+		return nil, fmt.Errorf("token introspection failed: %w", err)
+	}
+	result := introspectionResult{expires: time.Now().Add(time.Duration(i.conf.CacheTTL))}
+	if active, _ := claims["active"].(bool); !active {
+		result.err = errors.New("token is not active")
+	} else if exp, ok := claims["exp"].(float64); ok && time.Unix(int64(exp), 0).Before(time.Now()) {
+		result.err = errors.New("token is expired")
+	} else if i.conf.Audience != "" && !slices.Contains(claimValues(claims, "aud"), i.conf.Audience) {
+		result.err = errors.New("token has invalid audience")
+	} else {
+		result.identity = identityFromClaims(token, claims, i.conf.Claim, i.conf.Scopes)
+		// 缓存时间不超过令牌的过期时间
+		if ok {
+			result.expires = minTime(result.expires, time.Unix(int64(exp), 0))
+		}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	now := time.Now()
+	for cachedKey, entry := range i.cache {
+		if now.After(entry.expires) {
+			delete(i.cache, cachedKey)
+		}
+	}
+	i.cache[key] = result
+	return result.identity, result.err
+}
+
+// introspect 调用内省端点并返回响应中的字段
+func (i *introspector) introspect(ctx context.Context, token string) (map[string]any, error) {
+	ctx, cancel := context.WithTimeout(ctx, introspectionTimeout)
+	defer cancel()
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.conf.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if i.conf.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(i.conf.ClientID), url.QueryEscape(i.conf.ClientSecret))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var claims map[string]any
+	if err = json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// minTime 返回两个时间中较早的一个
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// oauthResource 发布受保护资源和授权服务器的元数据，并为路由生成认证质询
+type oauthResource struct {
+	conf    *OAuthConfig
+	baseURL *url.URL
+
+	mu               sync.Mutex
+	serverMetadata   []byte    // 缓存的授权服务器元数据
+	serverMetadataAt time.Time // 授权服务器元数据的获取时间
+}
+
+// newOAuthResource 根据配置创建受保护资源，未配置时返回 nil
+func newOAuthResource(conf *OAuthConfig, baseURL *url.URL) *oauthResource {
+	if conf == nil {
+		return nil
+	}
+	return &oauthResource{conf: conf, baseURL: baseURL}
+}
+
+// resourceURL 返回给定路径对应的资源标识，路径为空时表示整个代理
+func (o *oauthResource) resourceURL(resourcePath string) string {
+	return (&url.URL{Scheme: o.baseURL.Scheme, Host: o.baseURL.Host, Path: resourcePath}).String()
+}
+
+// challenge 返回给定路由的认证质询，未配置 OAuth 时返回 nil
+func (o *oauthResource) challenge(route string) *oauthChallenge {
+	if o == nil {
+		return nil
+	}
+	resourcePath := strings.TrimSuffix(routePath(o.baseURL, route), "/")
+	return &oauthChallenge{
+		metadataURL: o.resourceURL(oauthResourceMetadataPath + resourcePath),
+		scope:       strings.Join(o.conf.ScopesSupported, " "),
+		required:    o.conf.RequiredScopes,
+	}
+}
+
+// metadataHandler 返回发布受保护资源元数据的处理器。
+// 元数据的路径是 oauthResourceMetadataPath 加上资源的路径，只发布整个代理和给定路由下的资源。
+func (o *oauthResource) metadataHandler(routes []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resourcePath := strings.TrimPrefix(r.URL.Path, oauthResourceMetadataPath)
+		if resourcePath != "" && !slices.ContainsFunc(routes, func(route string) bool {
+			return strings.HasPrefix(resourcePath+"/", route)
+		}) {
+			http.NotFound(w, r)
+			return
+		}
+		metadata := map[string]any{
+			"resource":                 o.resourceURL(resourcePath),
+			"authorization_servers":    o.conf.AuthorizationServers,
+			"bearer_methods_supported": []string{"header"},
+		}
+		if len(o.conf.ScopesSupported) > 0 {
+			metadata["scopes_supported"] = o.conf.ScopesSupported
+		}
+		if o.conf.ResourceName != "" {
+			metadata["resource_name"] = o.conf.ResourceName
+		}
+		if o.conf.ResourceDocumentation != "" {
+			metadata["resource_documentation"] = o.conf.ResourceDocumentation
+		}
+		// 浏览器中的客户端需要跨域读取元数据
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		writeJSON(w, http.StatusOK, metadata)
+	})
+}
+
+// serverMetadataHandler 返回转发第一个授权服务器元数据的处理器，
+// 供只会在 MCP 服务器上查找授权服务器元数据的旧版客户端使用。
+func (o *oauthResource) serverMetadataHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metadata, err := o.authorizationServerMetadata(r.Context())
+		if err != nil {
+			log.Printf("Failed to fetch authorization server metadata: %v", err)
+			writeError(w, http.StatusBadGateway, errors.New("authorization server metadata is unavailable"))
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(metadata)
+	})
+}
+
+// authorizationServerMetadata 返回缓存的授权服务器元数据，过期时重新获取，获取失败时继续使用缓存
+func (o *oauthResource) authorizationServerMetadata(ctx context.Context) ([]byte, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.serverMetadata != nil && time.Since(o.serverMetadataAt) < oauthServerMetadataTTL {
+		return o.serverMetadata, nil
+	}
+	metadata, err := fetchAuthorizationServerMetadata(ctx, o.conf.AuthorizationServers[0])
+	if err != nil {
+		if o.serverMetadata != nil {
+			log.Printf("Failed to refresh authorization server metadata, using cached one: %v", err)
+			return o.serverMetadata, nil
+		}
+		return nil, err
+	}
+	o.serverMetadata, o.serverMetadataAt = metadata, time.Now()
+	return metadata, nil
+}
+
+// fetchAuthorizationServerMetadata 按 RFC 8414 获取授权服务器元数据，找不到时尝试 OpenID Connect 发现文档
+func fetchAuthorizationServerMetadata(ctx context.Context, issuer string) ([]byte, error) {
+	issuerURL, err := url.Parse(issuer)
+	if err != nil {
+		return nil, err
+	}
+	issuerPath := strings.TrimSuffix(issuerURL.Path, "/")
+	candidates := []string{
+		(&url.URL{Scheme: issuerURL.Scheme, Host: issuerURL.Host, Path: oauthServerMetadataPath + issuerPath}).String(),
+		(&url.URL{Scheme: issuerURL.Scheme, Host: issuerURL.Host, Path: issuerPath + "/.well-known/openid-configuration"}).String(),
+	}
+	for _, candidate := range candidates {
+		var data []byte
+		if data, err = fetchMetadata(ctx, candidate); err == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+// fetchMetadata 获取一个 JSON 元数据文档
+func fetchMetadata(ctx context.Context, metadataURL string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, introspectionTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status %s", metadataURL, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("%s: invalid JSON", metadataURL)
+	}
+	return data, nil
+}
+
+// oauthChallenge 生成路由认证失败时的响应，为 nil 时只返回不带质询的 401
+type oauthChallenge struct {
+	metadataURL string   // 路由的受保护资源元数据地址
+	scope       string   // 以空格分隔的建议申请的 scope
+	required    []string // 访问令牌必须具有的 scope
+}
+
+// unauthorized 返回 401，errorCode 为空表示请求没有携带令牌
+func (c *oauthChallenge) unauthorized(w http.ResponseWriter, errorCode, description string) {
+	if c != nil {
+		params := make([]string, 0, 4)
+		if errorCode != "" {
+			params = append(params, fmt.Sprintf("error=%q", errorCode), fmt.Sprintf("error_description=%q", description))
+		}
+		if c.scope != "" {
+			params = append(params, fmt.Sprintf("scope=%q", c.scope))
+		}
+		params = append(params, fmt.Sprintf("resource_metadata=%q", c.metadataURL))
+		w.Header().Set("WWW-Authenticate", "Bearer "+strings.Join(params, ", "))
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// authorize 检查访问令牌是否具有所有必需的 scope，不满足时返回 403 并返回 false
+// 静态令牌和具名调用方的令牌不是 OAuth 令牌，不做检查
+func (c *oauthChallenge) authorize(w http.ResponseWriter, identity *Identity, verified bool) bool {
+	if c == nil || !verified {
+		return true
+	}
+	missing := slices.DeleteFunc(slices.Clone(c.required), func(required string) bool {
+		return slices.Contains(identity.oauthScopes, required)
+	})
+	if len(missing) == 0 {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer error=\"insufficient_scope\", scope=%q, resource_metadata=%q",
+		strings.Join(c.required, " "), c.metadataURL))
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
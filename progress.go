@@ -0,0 +1,242 @@
+// progress.go 文件实现了长时间运行的调用的进度通知和取消的转发。
+// 下游工具调用携带的进度令牌会被替换为后端连接上唯一的令牌，后端的 notifications/progress 再还原为原始令牌发送给发起调用的会话；
+// 下游会话发送 notifications/cancelled 或结束时，进行中的调用的上下文会被取消，
+// 因上下文取消而放弃等待的后端请求会向后端发送 notifications/cancelled。
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"time"
+
+	"github.com/mark3labs/mcp-go/client/transport"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// cancelTimeout 是向后端发送取消通知的超时时间
+const cancelTimeout = 5 * time.Second
+
+// 进度和取消通知的方法名称，mcp-go 没有为它们定义常量
+const (
+	methodNotificationProgress  = "notifications/progress"
+	methodNotificationCancelled = "notifications/cancelled"
+)
+
+// errSessionClosed 是下游会话结束时取消进行中的请求的原因
+var errSessionClosed = errors.New("session closed")
+
+// cancellationKey 是上下文中下游请求的取消信号的键
+type cancellationKey struct{}
+
+// cancellation 是一个下游请求的取消信号，下游会话取消该请求或结束时被取消
+// SSE 传输在返回响应之前就结束了 HTTP 请求，因此不能直接使用 HTTP 请求的上下文
+type cancellation struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+// progressTarget 是接收进度通知的下游请求
+type progressTarget struct {
+	ctx   context.Context   // 下游请求的上下文，包含接收通知的 MCP 服务器和会话
+	token mcp.ProgressToken // 下游请求的原始进度令牌
+}
+
+// withCancellation 为每个 POST 请求创建取消信号并放到上下文中，请求开始处理时由 trackRequest 按请求 ID 记录
+func withCancellation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithCancelCause(context.Background())
+		r = r.WithContext(context.WithValue(r.Context(), cancellationKey{}, &cancellation{ctx: ctx, cancel: cancel}))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// trackRequest 按下游会话和请求 ID 记录请求的取消信号
+func (s *Server) trackRequest(ctx context.Context, id any) {
+	signal, ok := ctx.Value(cancellationKey{}).(*cancellation)
+	session := server.ClientSessionFromContext(ctx)
+	if !ok || session == nil {
+		return
+	}
+	s.reqMu.Lock()
+	defer s.reqMu.Unlock()
+	if s.requests == nil {
+		s.requests = make(map[string]map[string]context.CancelCauseFunc)
+	}
+	if s.requests[session.SessionID()] == nil {
+		s.requests[session.SessionID()] = make(map[string]context.CancelCauseFunc)
+	}
+	s.requests[session.SessionID()][mcp.NewRequestId(id).String()] = signal.cancel
+}
+
+// untrackRequest 在请求处理完成时移除它的取消信号
+func (s *Server) untrackRequest(ctx context.Context, id any) {
+	session := server.ClientSessionFromContext(ctx)
+	if session == nil {
+		return
+	}
+	s.reqMu.Lock()
+	defer s.reqMu.Unlock()
+	requests := s.requests[session.SessionID()]
+	delete(requests, mcp.NewRequestId(id).String())
+	if len(requests) == 0 {
+		delete(s.requests, session.SessionID())
+	}
+}
+
+// cancelRequest 处理下游会话发送的 notifications/cancelled，取消对应的请求
+func (s *Server) cancelRequest(ctx context.Context, notification mcp.JSONRPCNotification) {
+	session := server.ClientSessionFromContext(ctx)
+	id, ok := notification.Params.AdditionalFields["requestId"]
+	if session == nil || !ok {
+		return
+	}
+	s.reqMu.Lock()
+	cancel, exists := s.requests[session.SessionID()][mcp.NewRequestId(id).String()]
+	s.reqMu.Unlock()
+	if !exists {
+		return
+	}
+	reason, _ := notification.Params.AdditionalFields["reason"].(string)
+	log.Printf("Session %s cancelled request %v: %s", session.SessionID(), id, reason)
+	cause := errors.New("request cancelled by client")
+	if reason != "" {
+		cause = fmt.Errorf("request cancelled by client: %s", reason)
+	}
+	cancel(cause)
+}
+
+// cancelRequests 在下游会话结束时取消它所有进行中的请求
+func (s *Server) cancelRequests(sessionID string) {
+	s.reqMu.Lock()
+	requests := s.requests[sessionID]
+	delete(s.requests, sessionID)
+	s.reqMu.Unlock()
+	for _, cancel := range requests {
+		cancel(errSessionClosed)
+	}
+}
+
+// linkCancellation 返回在下游取消请求时也会被取消的上下文，调用结束后需要调用返回的函数
+func linkCancellation(ctx context.Context) (context.Context, func()) {
+	signal, ok := ctx.Value(cancellationKey{}).(*cancellation)
+	if !ok {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := context.AfterFunc(signal.ctx, func() {
+		cancel(context.Cause(signal.ctx))
+	})
+	return ctx, func() {
+		stop()
+		cancel(nil)
+	}
+}
+
+// trackProgress 把下游请求的进度令牌替换为后端连接上唯一的令牌，返回转发给后端的元数据
+// 不同下游会话可能使用相同的令牌，共享的连接上需要区分；调用结束后需要调用返回的函数
+func (c *Client) trackProgress(ctx context.Context, meta *mcp.Meta) (*mcp.Meta, func()) {
+	if meta == nil || meta.ProgressToken == nil || server.ServerFromContext(ctx) == nil {
+		return meta, func() {}
+	}
+	c.mu.Lock()
+	c.progressSeq++
+	token := fmt.Sprintf("mcp-proxy-%d", c.progressSeq)
+	if c.progress == nil {
+		c.progress = make(map[string]progressTarget)
+	}
+	c.progress[token] = progressTarget{ctx: ctx, token: meta.ProgressToken}
+	c.mu.Unlock()
+
+	forwarded := *meta
+	forwarded.ProgressToken = token
+	return &forwarded, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.progress, token)
+	}
+}
+
+// forwardProgress 把后端的进度通知还原为原始的进度令牌，发送给发起调用的下游会话
+// 调用已经结束或令牌不是由代理分配的通知会被丢弃
+func (c *Client) forwardProgress(notification mcp.JSONRPCNotification) {
+	token, _ := notification.Params.AdditionalFields["progressToken"].(string)
+	c.mu.RLock()
+	target, ok := c.progress[token]
+	c.mu.RUnlock()
+	if !ok {
+		return
+	}
+	params := maps.Clone(notification.Params.AdditionalFields)
+	params["progressToken"] = target.token
+	if err := server.ServerFromContext(target.ctx).SendNotificationToClient(target.ctx, notification.Method, params); err != nil {
+		log.Printf("<%s> Failed to forward %s: %v", c.name, notification.Method, err)
+	}
+}
+
+// cancellingTransport 包装底层客户端的传输层，请求因上下文取消或超时而放弃等待时向后端发送 notifications/cancelled
+// mcp-go 的客户端不会发送取消通知，也不会公开请求 ID，只能在传输层完成
+type cancellingTransport struct {
+	transport.Interface
+	name string // 后端名称，用于日志
+}
+
+// SendRequest 发送请求，上下文被取消时通知后端取消该请求
+func (t *cancellingTransport) SendRequest(ctx context.Context, request transport.JSONRPCRequest) (*transport.JSONRPCResponse, error) {
+	response, err := t.Interface.SendRequest(ctx, request)
+	// 规范不允许取消 initialize 请求
+	if err != nil && ctx.Err() != nil && request.Method != string(mcp.MethodInitialize) {
+		t.cancel(request.ID, context.Cause(ctx))
+	}
+	return response, err
+}
+
+// cancel 通知后端取消请求
+func (t *cancellingTransport) cancel(id mcp.RequestId, cause error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+	notification := mcp.JSONRPCNotification{
+		JSONRPC: mcp.JSONRPC_VERSION,
+		Notification: mcp.Notification{
+			Method: methodNotificationCancelled,
+			Params: mcp.NotificationParams{
+				AdditionalFields: map[string]any{
+					"requestId": id,
+					"reason":    cause.Error(),
+				},
+			},
+		},
+	}
+	if err := t.Interface.SendNotification(ctx, notification); err != nil {
+		log.Printf("<%s> Failed to cancel request %v: %v", t.name, id.Value(), err)
+	}
+}
+
+// SetRequestHandler 在底层传输层支持时设置处理后端请求的函数
+func (t *cancellingTransport) SetRequestHandler(handler transport.RequestHandler) {
+	if bidirectional, ok := t.Interface.(transport.BidirectionalInterface); ok {
+		bidirectional.SetRequestHandler(handler)
+	}
+}
+
+// SetConnectionLostHandler 在底层传输层支持时设置连接断开的处理函数
+func (t *cancellingTransport) SetConnectionLostHandler(handler func(error)) {
+	if setter, ok := t.Interface.(interface{ SetConnectionLostHandler(func(error)) }); ok {
+		setter.SetConnectionLostHandler(handler)
+	}
+}
+
+// SetProtocolVersion 在底层传输层是 HTTP 连接时设置协商的协议版本
+func (t *cancellingTransport) SetProtocolVersion(version string) {
+	if httpConn, ok := t.Interface.(transport.HTTPConnection); ok {
+		httpConn.SetProtocolVersion(version)
+	}
+}
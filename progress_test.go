@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// testSession 是收集通知的下游会话
+type testSession struct {
+	id            string
+	notifications chan mcp.JSONRPCNotification
+}
+
+func (s *testSession) Initialize()                                         {}
+func (s *testSession) Initialized() bool                                   { return true }
+func (s *testSession) NotificationChannel() chan<- mcp.JSONRPCNotification { return s.notifications }
+func (s *testSession) SessionID() string                                   { return s.id }
+
+// requestContext 返回下游会话调用工具时处理函数收到的上下文，其中包含 MCP 服务器和会话
+func requestContext(t *testing.T, sessionID string) (context.Context, *testSession) {
+	t.Helper()
+	mcpServer := server.NewMCPServer("test", "1")
+	var captured context.Context
+	mcpServer.AddTool(mcp.NewTool("capture"), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		captured = ctx
+		return mcp.NewToolResultText(""), nil
+	})
+	session := &testSession{id: sessionID, notifications: make(chan mcp.JSONRPCNotification, 10)}
+	message := json.RawMessage(`{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"capture"}}`)
+	mcpServer.HandleMessage(mcpServer.WithContext(context.Background(), session), message)
+	if captured == nil {
+		t.Fatal("tool handler was not called")
+	}
+	return captured, session
+}
+
+// progressNotification 创建后端发送的进度通知
+func progressNotification(token any) mcp.JSONRPCNotification {
+	return mcp.JSONRPCNotification{
+		JSONRPC: mcp.JSONRPC_VERSION,
+		Notification: mcp.Notification{
+			Method: methodNotificationProgress,
+			Params: mcp.NotificationParams{AdditionalFields: map[string]any{"progressToken": token, "progress": 1.0}},
+		},
+	}
+}
+
+func TestTrackProgressPassthrough(t *testing.T) {
+	ctx, _ := requestContext(t, "s1")
+	tests := []struct {
+		name string
+		ctx  context.Context
+		meta *mcp.Meta
+	}{
+		{"no meta", ctx, nil},
+		{"no progress token", ctx, &mcp.Meta{}},
+		{"no downstream server", context.Background(), &mcp.Meta{ProgressToken: "p"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{name: "a"}
+			meta, done := c.trackProgress(tt.ctx, tt.meta)
+			defer done()
+			if meta != tt.meta {
+				t.Errorf("meta = %+v, want the original %+v", meta, tt.meta)
+			}
+			if len(c.progress) != 0 {
+				t.Errorf("progress = %v, want none", c.progress)
+			}
+		})
+	}
+}
+
+func TestForwardProgress(t *testing.T) {
+	tests := []struct {
+		name string
+		// forward 返回要发送给代理的后端通知的令牌，tokens 是两个会话转发给后端的令牌
+		forward   func(tokens [2]any) any
+		done      bool
+		wantFirst any
+		wantOther bool
+	}{
+		{name: "routed to the caller with its own token", forward: func(tokens [2]any) any { return tokens[0] }, wantFirst: 7},
+		{name: "same downstream token on another session", forward: func(tokens [2]any) any { return tokens[1] }, wantOther: true},
+		{name: "token not issued by the proxy", forward: func([2]any) any { return 7 }},
+		{name: "call already finished", forward: func(tokens [2]any) any { return tokens[0] }, done: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{name: "a"}
+			first, firstSession := requestContext(t, "s1")
+			other, otherSession := requestContext(t, "s2")
+			firstMeta, firstDone := c.trackProgress(first, &mcp.Meta{ProgressToken: 7})
+			otherMeta, otherDone := c.trackProgress(other, &mcp.Meta{ProgressToken: 7})
+			defer otherDone()
+			if firstMeta.ProgressToken == otherMeta.ProgressToken {
+				t.Fatalf("sessions share the forwarded token %v", firstMeta.ProgressToken)
+			}
+			if tt.done {
+				firstDone()
+			} else {
+				defer firstDone()
+			}
+
+			c.forwardProgress(progressNotification(tt.forward([2]any{firstMeta.ProgressToken, otherMeta.ProgressToken})))
+			select {
+			case notification := <-firstSession.notifications:
+				if tt.wantFirst == nil {
+					t.Fatalf("unexpected notification %+v", notification)
+				}
+				if got := notification.Params.AdditionalFields["progressToken"]; got != tt.wantFirst {
+					t.Errorf("progressToken = %v, want %v", got, tt.wantFirst)
+				}
+			default:
+				if tt.wantFirst != nil {
+					t.Error("caller did not receive the notification")
+				}
+			}
+			if got := len(otherSession.notifications) > 0; got != tt.wantOther {
+				t.Errorf("other session notified = %v, want %v", got, tt.wantOther)
+			}
+		})
+	}
+}
@@ -0,0 +1,425 @@
+// proxy.go 文件管理代理当前生效的配置，以及每个后端对应的客户端、服务器和路由。
+// 重新加载配置时会与当前配置逐项比较：新增的后端会被启动，被移除的后端在排空进行中的调用后关闭，
+// 只有选项发生变化的后端会原地应用新的选项，已连接的下游会话不受影响。
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"golang.org/x/sync/errgroup"
+)
+
+// drainTimeout 是移除后端时等待进行中的调用完成的最长时间
+const drainTimeout = 30 * time.Second
+
+// backend 是一个已启动的后端及其路由
+type backend struct {
+	config  *MCPClientConfig   // 启动该后端时使用的配置
+	client  *Client            // 后端客户端
+	server  *Server            // 对外提供该后端能力的服务器
+	handler http.Handler       // 路由的处理器，不包含随选项变化的中间件
+	cancel  context.CancelFunc // 取消路由上仍在进行的请求，例如 SSE 长连接
+}
+
+// proxy 持有代理当前生效的配置和所有后端，并把请求分发到对应的路由
+type proxy struct {
+	configPath string             // 配置文件路径或 URL，重新加载时使用
+	ctx        context.Context    // 所有后端监督任务的父上下文
+	baseURL    *url.URL           // 代理服务器的基础 URL
+	info       mcp.Implementation // 连接后端时使用的客户端信息
+	audit      *auditLogger       // 审计日志，未启用时为 nil
+	verifier   *tokenVerifier     // 访问令牌校验器，未配置 JWT 和令牌内省时为 nil
+	oauth      *oauthResource     // OAuth 受保护资源，未启用时为 nil
+
+	reloadMu sync.Mutex // 保证同一时间只有一次配置应用在进行
+
+	mu              sync.RWMutex
+	config          *Config             // 当前生效的配置
+	backends        map[string]*backend // 服务器名称 -> 后端
+	aggregate       *registry           // 聚合路由的注册表，未启用时为 nil
+	aggregateServer *Server             // 聚合路由的服务器，未启用时为 nil
+	handler         http.Handler        // 根据当前配置构建的路由
+}
+
+// newProxy 根据启动时的配置创建代理，后端需要调用 apply 才会启动
+func newProxy(ctx context.Context, configPath string, config *Config) (*proxy, error) {
+	baseURL, err := url.Parse(config.McpProxy.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	p := &proxy{
+		configPath: configPath,
+		ctx:        ctx,
+		baseURL:    baseURL,
+		info: mcp.Implementation{
+			Name:    config.McpProxy.Name,
+			Version: config.McpProxy.Version,
+		},
+		audit:    newAuditLogger(config.McpProxy.Audit),
+		verifier: newTokenVerifier(config.McpProxy.JWT, config.McpProxy.OAuth),
+		oauth:    newOAuthResource(config.McpProxy.OAuth, baseURL),
+		backends: make(map[string]*backend),
+		handler:  http.NotFoundHandler(),
+	}
+
+	// 如果启用了聚合路由，创建聚合服务器，后端连接成功后会陆续注册到其中。
+	if config.McpProxy.Aggregate != nil {
+		p.aggregateServer = newMCPServer(config.McpProxy.Aggregate.Route, config.McpProxy.Version, config.McpProxy.BaseURL, config.McpProxy.Options)
+		p.aggregate = newAggregator(config.McpProxy.Aggregate, p.aggregateServer.mcpServer)
+		p.aggregateServer.origin = p.aggregate.toolOrigin
+		p.aggregateServer.resourceOwner = func(uri string) (*Client, bool) {
+			owner, ok := p.aggregate.resourceOwner(uri)
+			if !ok {
+				return nil, false
+			}
+			return p.client(owner)
+		}
+		p.aggregateServer.backends = p.clients
+		// 聚合路由的会话可能在任意后端上建立了会话专属的连接
+		p.aggregateServer.sessionClosed = func(sessionID string) {
+			for _, c := range p.clients() {
+				c.closeSession(sessionID)
+			}
+		}
+	}
+	return p, nil
+}
+
+// ServeHTTP 实现了 http.Handler 接口，把请求交给根据当前配置构建的路由
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	handler := p.handler
+	p.mu.RUnlock()
+	handler.ServeHTTP(w, r)
+}
+
+// reload 重新加载配置文件并应用变化，配置无效时保留当前配置
+func (p *proxy) reload() error {
+	config, err := load(p.configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	return p.apply(config, false)
+}
+
+// apply 把新的配置与当前配置比较并应用差异
+// startup 为 true 时表示首次启动，设置了 PanicIfInvalid 的后端首次连接失败会导致代理退出；
+// 重新加载时新增的后端连接失败只会被记录，然后在后台重试
+func (p *proxy) apply(config *Config, startup bool) error {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+
+	p.mu.RLock()
+	previous := p.config
+	p.mu.RUnlock()
+	if previous != nil {
+		if reflect.DeepEqual(previous, config) {
+			return nil
+		}
+		warnRestartRequired(previous.McpProxy, config.McpProxy)
+	}
+
+	p.mu.Lock()
+	// 先为新增和连接方式发生变化的后端创建客户端和服务器，任何一个失败时保持当前配置不变
+	created := make(map[string]*backend)
+	for name, clientConfig := range config.McpServers {
+		if b, exists := p.backends[name]; exists && !requiresRestart(b.config, clientConfig) {
+			continue
+		}
+		b, err := p.newBackend(name, clientConfig)
+		if err != nil {
+			p.mu.Unlock()
+			for _, b := range created {
+				b.cancel()
+			}
+			return fmt.Errorf("<%s> failed to create client: %w", name, err)
+		}
+		created[name] = b
+	}
+
+	// 移除配置中已不存在的后端
+	for name, b := range p.backends {
+		if _, exists := config.McpServers[name]; !exists {
+			log.Printf("<%s> Removed from config", name)
+			p.removeBackend(name, b)
+		}
+	}
+	// 启动新增的后端，替换连接方式发生变化的后端，对其他后端原地应用新的选项
+	var errorGroup errgroup.Group
+	for name, clientConfig := range config.McpServers {
+		b, exists := p.backends[name]
+		replacement, ok := created[name]
+		switch {
+		case !ok:
+			p.updateBackend(name, b, clientConfig)
+			continue
+		case !exists:
+			if !startup {
+				log.Printf("<%s> Added to config", name)
+			}
+		default:
+			log.Printf("<%s> Connection settings changed, restarting", name)
+			p.removeBackend(name, b)
+		}
+		p.addBackend(name, replacement)
+		errorGroup.Go(func() error {
+			return p.connectBackend(name, replacement, startup)
+		})
+	}
+	p.config = config
+	p.handler = p.routes()
+	p.mu.Unlock()
+
+	if !startup {
+		log.Printf("Configuration reloaded")
+	}
+	// 等待所有新增的后端完成首次初始化。
+	// 首次启动时，如果任何客户端初始化失败并配置为 panic，这将导致致命错误。
+	go func() {
+		err := errorGroup.Wait()
+		if err != nil {
+			log.Fatalf("Failed to add clients: %v", err)
+		}
+		if startup {
+			log.Printf("All clients initialized")
+		}
+	}()
+	return nil
+}
+
+// newBackend 为后端创建客户端和服务器，在 addBackend 之前不会影响当前的后端和路由
+func (p *proxy) newBackend(name string, clientConfig *MCPClientConfig) (*backend, error) {
+	mcpClient, err := newMCPClient(name, clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	mcpClient.audit = p.audit
+	server := newMCPServer(name, p.info.Version, p.baseURL.String(), clientConfig.Options)
+	server.sessionClosed = mcpClient.closeSession
+	server.resourceOwner = func(string) (*Client, bool) {
+		return mcpClient, true
+	}
+	server.backends = func() []*Client {
+		return []*Client{mcpClient}
+	}
+
+	// SSE 和 Streamable HTTP 端点共享同一条中间件链；后端首次连接成功之前，路由会以 503 响应。
+	// 后端被移除时，取消路由上下文会结束仍然挂在该路由上的 SSE 长连接。
+	routeCtx, cancel := context.WithCancel(p.ctx)
+	mcpRoute := routePath(p.baseURL, name)
+	handler := chainMiddleware(server.handler(mcpRoute), readinessMiddleware(mcpClient), routeContextMiddleware(routeCtx))
+
+	return &backend{
+		config:  clientConfig,
+		client:  mcpClient,
+		server:  server,
+		handler: handler,
+		cancel:  cancel,
+	}, nil
+}
+
+// addBackend 把创建好的后端加入代理，调用方需要持有 p.mu
+func (p *proxy) addBackend(name string, b *backend) {
+	// 将后端关联到聚合路由，连接成功后其能力会被同步过去，名称冲突会在同步时被报告而不是被静默覆盖。
+	if p.aggregate != nil {
+		b.client.attach(p.aggregate)
+	}
+	p.backends[name] = b
+}
+
+// connectBackend 连接到后端 MCP 服务，并将其能力（工具等）注册到代理的服务器实例中。
+func (p *proxy) connectBackend(name string, b *backend, startup bool) error {
+	log.Printf("<%s> Connecting", name)
+	addErr := b.client.addToMCPServer(p.ctx, p.info, b.server.mcpServer)
+	if addErr != nil {
+		log.Printf("<%s> Failed to add client to server: %v", name, addErr)
+		// 如果 PanicIfInvalid 为 true，首次启动时的失败将导致整个代理服务停止启动。
+		if startup && b.config.Options.PanicIfInvalid.OrElse(false) {
+			return addErr
+		}
+		// 否则后端会按照重启策略在后台重试连接。
+		log.Printf("<%s> Retrying in background", name)
+		return nil
+	}
+	log.Printf("<%s> Connected", name)
+	return nil
+}
+
+// updateBackend 对已有的后端原地应用新的选项，调用方需要持有 p.mu
+// 认证令牌和日志开关会在重新构建路由时生效，工具过滤器和命名空间的变化需要重新同步能力列表
+func (p *proxy) updateBackend(name string, b *backend, clientConfig *MCPClientConfig) {
+	previous := b.config.Options
+	b.config = clientConfig
+	if reflect.DeepEqual(previous, clientConfig.Options) {
+		return
+	}
+	log.Printf("<%s> Options changed, applying", name)
+	b.client.setOptions(clientConfig.Options)
+	if reflect.DeepEqual(previous.ToolFilter, clientConfig.Options.ToolFilter) && previous.Namespace == clientConfig.Options.Namespace {
+		return
+	}
+	go func() {
+		if err := b.client.refresh(p.ctx); err != nil {
+			// 后端当前不可用时，新的选项会在重连成功后生效
+			log.Printf("<%s> Failed to refresh capabilities: %v", name, err)
+		}
+	}()
+}
+
+// removeBackend 卸载后端的路由并在后台排空、关闭它，调用方需要持有 p.mu
+func (p *proxy) removeBackend(name string, b *backend) {
+	delete(p.backends, name)
+	if p.aggregate != nil {
+		p.aggregate.removeClient(b.client)
+		// 之前与被移除后端冲突而被跳过的能力现在可以注册了
+		for _, other := range p.backends {
+			_ = p.aggregate.syncClient(other.client)
+		}
+	}
+	go func() {
+		log.Printf("<%s> Draining", name)
+		_ = b.client.drain(drainTimeout)
+		b.cancel()
+		log.Printf("<%s> Removed", name)
+	}()
+}
+
+// routes 根据当前的后端和配置构建路由，调用方需要持有 p.mu
+func (p *proxy) routes() http.Handler {
+	httpMux := http.NewServeMux()
+	if p.aggregateServer != nil {
+		// 聚合路由使用代理的全局选项
+		aggregateName := p.aggregate.name
+		aggregateRoute := routePath(p.baseURL, aggregateName)
+		handler := chainMiddleware(p.aggregateServer.handler(aggregateRoute), requestHeaderMiddleware, tracingMiddleware(aggregateName))
+		handler = chainMiddleware(handler, newRouteMiddlewares(aggregateName, p.config.McpProxy.Options, p.verifier, p.oauth)...)
+		httpMux.Handle(aggregateRoute, chainMiddleware(handler, metricsMiddleware(aggregateName)))
+	}
+	if metrics := p.config.McpProxy.Metrics; metrics != nil && metrics.Addr == "" {
+		httpMux.Handle(metrics.Path, metricsHandler(metrics))
+	}
+	if p.oauth != nil {
+		// 受保护资源元数据位于根路径下，只为当前存在的路由发布
+		routes := make([]string, 0, len(p.backends)+1)
+		if p.aggregate != nil {
+			routes = append(routes, routePath(p.baseURL, p.aggregate.name))
+		}
+		for name := range p.backends {
+			routes = append(routes, routePath(p.baseURL, name))
+		}
+		metadataHandler := p.oauth.metadataHandler(routes)
+		httpMux.Handle("GET "+oauthResourceMetadataPath, metadataHandler)
+		httpMux.Handle("GET "+oauthResourceMetadataPath+"/", metadataHandler)
+		httpMux.Handle("GET "+oauthServerMetadataPath, p.oauth.serverMetadataHandler())
+	}
+	for name, b := range p.backends {
+		// 为特定的 MCP 服务器路由注册最终的处理程序，该处理程序被其自己的中间件包裹。
+		// 指标中间件位于最外层，这样认证失败的请求也会被统计。
+		handler := chainMiddleware(b.handler, requestHeaderMiddleware, tracingMiddleware(name))
+		handler = chainMiddleware(handler, newRouteMiddlewares(name, b.config.Options, p.verifier, p.oauth)...)
+		httpMux.Handle(routePath(p.baseURL, name), chainMiddleware(handler, metricsMiddleware(name)))
+	}
+	return httpMux
+}
+
+// client 返回给定名称的后端客户端
+func (p *proxy) client(name string) (*Client, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	b, ok := p.backends[name]
+	if !ok {
+		return nil, false
+	}
+	return b.client, true
+}
+
+// clients 按名称排序返回所有后端客户端
+func (p *proxy) clients() []*Client {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	clients := make([]*Client, 0, len(p.backends))
+	for _, name := range slices.Sorted(maps.Keys(p.backends)) {
+		clients = append(clients, p.backends[name].client)
+	}
+	return clients
+}
+
+// close 关闭所有后端的客户端连接
+func (p *proxy) close() {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for name, b := range p.backends {
+		log.Printf("<%s> Shutting down", name)
+		_ = b.client.Close()
+		b.cancel()
+	}
+	_ = p.audit.Close()
+}
+
+// requiresRestart 判断后端的连接方式是否发生了变化，变化时需要重新创建客户端和服务器
+// 选项中只有对外传输类型需要重新创建服务器，其余选项都可以原地应用
+func requiresRestart(previous, next *MCPClientConfig) bool {
+	previousConn, nextConn := *previous, *next
+	previousConn.Options, nextConn.Options = nil, nil
+	if !reflect.DeepEqual(previousConn, nextConn) {
+		return true
+	}
+	return !slices.Equal(previous.Options.Transports, next.Options.Transports)
+}
+
+// warnRestartRequired 对无法在运行时应用的代理配置变化给出警告
+func warnRestartRequired(previous, next *MCPProxyConfig) {
+	changed := make([]string, 0)
+	if previous.BaseURL != next.BaseURL {
+		changed = append(changed, "baseURL")
+	}
+	if previous.Addr != next.Addr {
+		changed = append(changed, "addr")
+	}
+	if previous.Name != next.Name {
+		changed = append(changed, "name")
+	}
+	if previous.Version != next.Version {
+		changed = append(changed, "version")
+	}
+	if !reflect.DeepEqual(previous.Aggregate, next.Aggregate) {
+		changed = append(changed, "aggregate")
+	}
+	if !reflect.DeepEqual(previous.Reload, next.Reload) {
+		changed = append(changed, "reload")
+	}
+	if !reflect.DeepEqual(previous.Tracing, next.Tracing) {
+		changed = append(changed, "tracing")
+	}
+	if !reflect.DeepEqual(previous.Audit, next.Audit) {
+		changed = append(changed, "audit")
+	}
+	if !reflect.DeepEqual(previous.JWT, next.JWT) {
+		changed = append(changed, "jwt")
+	}
+	if !reflect.DeepEqual(previous.OAuth, next.OAuth) {
+		changed = append(changed, "oauth")
+	}
+	if !reflect.DeepEqual(previous.Admin, next.Admin) {
+		changed = append(changed, "admin")
+	}
+	if previous.Metrics != nil && next.Metrics != nil && previous.Metrics.Addr != next.Metrics.Addr {
+		changed = append(changed, "metrics.addr")
+	}
+	if !slices.Equal(previous.Options.Transports, next.Options.Transports) {
+		changed = append(changed, "options.transports")
+	}
+	if len(changed) > 0 {
+		log.Printf("Changes to mcpProxy %v require a restart to take effect", changed)
+	}
+}
@@ -0,0 +1,263 @@
+// registry.go 文件负责把后端的能力注册到代理的 MCP 服务器上。
+// 每个路由都有一个只包含单个后端的注册表；聚合路由的注册表包含所有后端，
+// 工具和提示会加上命名空间前缀，调用时再根据前缀路由回对应的后端。
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"reflect"
+	"slices"
+	"sync"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// registered 记录一个已注册条目及其所属的后端
+type registered[T any] struct {
+	owner string
+	item  T
+}
+
+// registry 负责把后端的能力同步到一个 MCP 服务器上，并检测名称冲突
+type registry struct {
+	name      string            // 注册表名称（即路由名称），用于日志
+	separator string            // 命名空间与原始名称之间的分隔符，为空时不添加命名空间前缀
+	mcpServer *server.MCPServer // 能力注册到的 MCP 服务器实例
+
+	mu                sync.Mutex
+	tools             map[string]registered[server.ServerTool]             // 已注册的工具名称 -> 工具
+	prompts           map[string]registered[server.ServerPrompt]           // 已注册的提示名称 -> 提示
+	resources         map[string]registered[server.ServerResource]         // 已注册的资源 URI -> 资源
+	resourceTemplates map[string]registered[server.ServerResourceTemplate] // 已注册的资源模板 URI -> 资源模板
+	origins           map[string]string                                    // 已注册的工具名称 -> 工具在后端的原始名称
+}
+
+// newRegistry 创建一个新的注册表，能力会注册到给定的 MCP 服务器上
+func newRegistry(name, separator string, mcpServer *server.MCPServer) *registry {
+	return &registry{
+		name:              name,
+		separator:         separator,
+		mcpServer:         mcpServer,
+		tools:             make(map[string]registered[server.ServerTool]),
+		prompts:           make(map[string]registered[server.ServerPrompt]),
+		resources:         make(map[string]registered[server.ServerResource]),
+		resourceTemplates: make(map[string]registered[server.ServerResourceTemplate]),
+		origins:           make(map[string]string),
+	}
+}
+
+// newAggregator 创建聚合路由的注册表，所有后端的工具和提示都会加上命名空间前缀
+func newAggregator(conf *AggregateConfig, mcpServer *server.MCPServer) *registry {
+	return newRegistry(conf.Route, conf.Separator, mcpServer)
+}
+
+// addClient 关联一个客户端并立即同步它当前的能力，之后客户端重连时会自动重新同步
+func (r *registry) addClient(c *Client) error {
+	c.attach(r)
+	return r.syncClient(c)
+}
+
+// removeClient 取消与客户端的关联，并移除它注册的所有能力
+func (r *registry) removeClient(c *Client) {
+	c.detach(r)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var errs []error
+	if replaceOwned(r, "tool", r.tools, c.name, nil, &errs) {
+		r.mcpServer.SetTools(registeredItems(r.tools)...)
+	}
+	r.updateOrigins(c.name, nil)
+	if replaceOwned(r, "prompt", r.prompts, c.name, nil, &errs) {
+		r.mcpServer.SetPrompts(registeredItems(r.prompts)...)
+	}
+	if replaceOwned(r, "resource", r.resources, c.name, nil, &errs) {
+		r.mcpServer.SetResources(registeredItems(r.resources)...)
+	}
+	if replaceOwned(r, "resource template", r.resourceTemplates, c.name, nil, &errs) {
+		r.mcpServer.SetResourceTemplates(registeredItems(r.resourceTemplates)...)
+	}
+}
+
+// updateOrigins 记录后端实际注册成功的工具的原始名称，调用方需要持有 r.mu
+func (r *registry) updateOrigins(owner string, origins map[string]string) {
+	for name := range r.origins {
+		if entry, exists := r.tools[name]; !exists || entry.owner == owner {
+			delete(r.origins, name)
+		}
+	}
+	for name, originalName := range origins {
+		if r.tools[name].owner == owner {
+			r.origins[name] = originalName
+		}
+	}
+}
+
+// toolOrigin 返回已注册工具所属的后端和它在后端的原始名称
+func (r *registry) toolOrigin(name string) (string, string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, exists := r.tools[name]
+	if !exists {
+		return "", "", false
+	}
+	return entry.owner, r.origins[name], true
+}
+
+// resourceOwner 返回资源所属的后端，先按 URI 查找资源，再查找能够匹配该 URI 的资源模板
+func (r *registry) resourceOwner(uri string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, exists := r.resources[uri]; exists {
+		return entry.owner, true
+	}
+	for _, name := range slices.Sorted(maps.Keys(r.resourceTemplates)) {
+		entry := r.resourceTemplates[name]
+		if entry.item.Template.URITemplate != nil && entry.item.Template.URITemplate.Regexp().MatchString(uri) {
+			return entry.owner, true
+		}
+	}
+	return "", false
+}
+
+// qualify 返回能力在此注册表中使用的名称
+func (r *registry) qualify(c *Client, name string) string {
+	if r.separator == "" {
+		return name
+	}
+	return c.namespace() + r.separator + name
+}
+
+// syncClient 用客户端当前的能力列表替换它之前注册的条目
+// 与其他后端已注册条目冲突的能力会被跳过，所有冲突会合并为一个错误返回
+func (r *registry) syncClient(c *Client) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current := c.snapshot()
+	var errs []error
+
+	// 工具使用限定名称注册，调用时还原为原始名称再转发
+	tools := make(map[string]server.ServerTool, len(current.tools))
+	origins := make(map[string]string, len(current.tools))
+	for _, tool := range current.tools {
+		originalName := tool.Name
+		tool.Name = r.qualify(c, originalName)
+		origins[tool.Name] = originalName
+		handler := c.callTool
+		if tool.Name != originalName {
+			handler = func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+				request.Params.Name = originalName
+				return c.callTool(ctx, request)
+			}
+		}
+		tools[tool.Name] = server.ServerTool{Tool: tool, Handler: handler}
+	}
+	if replaceOwned(r, "tool", r.tools, c.name, tools, &errs) {
+		r.mcpServer.SetTools(registeredItems(r.tools)...)
+	}
+	r.updateOrigins(c.name, origins)
+
+	// 提示与工具相同，使用限定名称注册
+	prompts := make(map[string]server.ServerPrompt, len(current.prompts))
+	for _, prompt := range current.prompts {
+		originalName := prompt.Name
+		prompt.Name = r.qualify(c, originalName)
+		handler := c.getPrompt
+		if prompt.Name != originalName {
+			handler = func(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+				request.Params.Name = originalName
+				return c.getPrompt(ctx, request)
+			}
+		}
+		prompts[prompt.Name] = server.ServerPrompt{Prompt: prompt, Handler: handler}
+	}
+	if replaceOwned(r, "prompt", r.prompts, c.name, prompts, &errs) {
+		r.mcpServer.SetPrompts(registeredItems(r.prompts)...)
+	}
+
+	// 资源和资源模板由 URI 标识，保持原样注册，只检测 URI 冲突
+	resources := make(map[string]server.ServerResource, len(current.resources))
+	for _, resource := range current.resources {
+		resources[resource.URI] = server.ServerResource{Resource: resource, Handler: c.readResource}
+	}
+	if replaceOwned(r, "resource", r.resources, c.name, resources, &errs) {
+		r.mcpServer.SetResources(registeredItems(r.resources)...)
+	}
+	resourceTemplates := make(map[string]server.ServerResourceTemplate, len(current.resourceTemplates))
+	for _, resourceTemplate := range current.resourceTemplates {
+		resourceTemplates[resourceTemplate.URITemplate.Raw()] = server.ServerResourceTemplate{Template: resourceTemplate, Handler: c.readResource}
+	}
+	if replaceOwned(r, "resource template", r.resourceTemplates, c.name, resourceTemplates, &errs) {
+		r.mcpServer.SetResourceTemplates(registeredItems(r.resourceTemplates)...)
+	}
+
+	return errors.Join(errs...)
+}
+
+// replaceOwned 把 entries 中属于 owner 的条目替换为 desired，定义没有变化的条目保持不变，
+// 与其他后端冲突的条目会被跳过并记录到 errs，返回条目是否发生了变化
+func replaceOwned[T any](r *registry, kind string, entries map[string]registered[T], owner string, desired map[string]T, errs *[]error) bool {
+	changed := false
+	for name, entry := range entries {
+		if entry.owner != owner {
+			continue
+		}
+		item, keep := desired[name]
+		if keep && sameDefinition(entry.item, item) {
+			continue
+		}
+		if !keep {
+			log.Printf("<%s> Removing %s %s", r.name, kind, name)
+		}
+		delete(entries, name)
+		changed = true
+	}
+	for _, name := range slices.Sorted(maps.Keys(desired)) {
+		if entry, exists := entries[name]; exists {
+			if entry.owner != owner {
+				*errs = append(*errs, fmt.Errorf("%s %s from %s conflicts with %s", kind, name, owner, entry.owner))
+			}
+			continue
+		}
+		log.Printf("<%s> Adding %s %s", r.name, kind, name)
+		entries[name] = registered[T]{owner: owner, item: desired[name]}
+		changed = true
+	}
+	return changed
+}
+
+// sameDefinition 判断两个已注册条目的定义是否相同，处理函数不参与比较
+// 同一个后端的同名条目的处理函数总是等价的，定义相同时无需重新注册，也不会通知下游
+func sameDefinition[T any](a, b T) bool {
+	switch a := any(a).(type) {
+	case server.ServerTool:
+		return reflect.DeepEqual(a.Tool, any(b).(server.ServerTool).Tool)
+	case server.ServerPrompt:
+		return reflect.DeepEqual(a.Prompt, any(b).(server.ServerPrompt).Prompt)
+	case server.ServerResource:
+		return reflect.DeepEqual(a.Resource, any(b).(server.ServerResource).Resource)
+	case server.ServerResourceTemplate:
+		// 解析后的 URI 模板带有延迟编译的正则表达式，按 JSON 比较
+		x, errX := json.Marshal(a.Template)
+		y, errY := json.Marshal(any(b).(server.ServerResourceTemplate).Template)
+		return errX == nil && errY == nil && bytes.Equal(x, y)
+	}
+	return false
+}
+
+// registeredItems 按名称排序返回所有已注册条目
+func registeredItems[T any](entries map[string]registered[T]) []T {
+	items := make([]T, 0, len(entries))
+	for _, name := range slices.Sorted(maps.Keys(entries)) {
+		items = append(items, entries[name].item)
+	}
+	return items
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+func testTool(name, description string) server.ServerTool {
+	return server.ServerTool{Tool: mcp.NewTool(name, mcp.WithDescription(description))}
+}
+
+func TestReplaceOwned(t *testing.T) {
+	tests := []struct {
+		name        string
+		entries     map[string]registered[server.ServerTool]
+		owner       string
+		desired     map[string]server.ServerTool
+		wantChanged bool
+		wantOwners  map[string]string
+		wantErrs    []string
+	}{
+		{
+			name:        "add to empty",
+			entries:     map[string]registered[server.ServerTool]{},
+			owner:       "a",
+			desired:     map[string]server.ServerTool{"x": testTool("x", "")},
+			wantChanged: true,
+			wantOwners:  map[string]string{"x": "a"},
+		},
+		{
+			name: "unchanged definition",
+			entries: map[string]registered[server.ServerTool]{
+				"x": {owner: "a", item: testTool("x", "old")},
+			},
+			owner:       "a",
+			desired:     map[string]server.ServerTool{"x": testTool("x", "old")},
+			wantChanged: false,
+			wantOwners:  map[string]string{"x": "a"},
+		},
+		{
+			name: "changed definition",
+			entries: map[string]registered[server.ServerTool]{
+				"x": {owner: "a", item: testTool("x", "old")},
+			},
+			owner:       "a",
+			desired:     map[string]server.ServerTool{"x": testTool("x", "new")},
+			wantChanged: true,
+			wantOwners:  map[string]string{"x": "a"},
+		},
+		{
+			name: "remove owned entries only",
+			entries: map[string]registered[server.ServerTool]{
+				"x": {owner: "a", item: testTool("x", "")},
+				"y": {owner: "b", item: testTool("y", "")},
+			},
+			owner:       "a",
+			desired:     nil,
+			wantChanged: true,
+			wantOwners:  map[string]string{"y": "b"},
+		},
+		{
+			name: "collision keeps existing owner",
+			entries: map[string]registered[server.ServerTool]{
+				"x": {owner: "b", item: testTool("x", "")},
+			},
+			owner:       "a",
+			desired:     map[string]server.ServerTool{"x": testTool("x", ""), "z": testTool("z", "")},
+			wantChanged: true,
+			wantOwners:  map[string]string{"x": "b", "z": "a"},
+			wantErrs:    []string{"tool x from a conflicts with b"},
+		},
+		{
+			name: "collision only",
+			entries: map[string]registered[server.ServerTool]{
+				"x": {owner: "b", item: testTool("x", "")},
+			},
+			owner:       "a",
+			desired:     map[string]server.ServerTool{"x": testTool("x", "")},
+			wantChanged: false,
+			wantOwners:  map[string]string{"x": "b"},
+			wantErrs:    []string{"tool x from a conflicts with b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRegistry("test", "", server.NewMCPServer("test", "1"))
+			var errs []error
+			changed := replaceOwned(r, "tool", tt.entries, tt.owner, tt.desired, &errs)
+			if changed != tt.wantChanged {
+				t.Errorf("changed = %v, want %v", changed, tt.wantChanged)
+			}
+			owners := make(map[string]string, len(tt.entries))
+			for name, entry := range tt.entries {
+				owners[name] = entry.owner
+			}
+			if !maps.Equal(owners, tt.wantOwners) {
+				t.Errorf("owners = %v, want %v", owners, tt.wantOwners)
+			}
+			var messages []string
+			for _, err := range errs {
+				messages = append(messages, err.Error())
+			}
+			if !slices.Equal(messages, tt.wantErrs) {
+				t.Errorf("errors = %q, want %q", messages, tt.wantErrs)
+			}
+		})
+	}
+}
+
+func TestSameDefinition(t *testing.T) {
+	template := func(uri string) server.ServerResourceTemplate {
+		return server.ServerResourceTemplate{Template: mcp.NewResourceTemplate(uri, "t")}
+	}
+	tests := []struct {
+		name string
+		a, b any
+		want bool
+	}{
+		{"same tool", testTool("x", "d"), testTool("x", "d"), true},
+		{"tool description differs", testTool("x", "d"), testTool("x", "e"), false},
+		{"same prompt", server.ServerPrompt{Prompt: mcp.NewPrompt("p")}, server.ServerPrompt{Prompt: mcp.NewPrompt("p")}, true},
+		{"prompt differs", server.ServerPrompt{Prompt: mcp.NewPrompt("p")}, server.ServerPrompt{Prompt: mcp.NewPrompt("q")}, false},
+		{"same resource", server.ServerResource{Resource: mcp.NewResource("file:///a", "a")}, server.ServerResource{Resource: mcp.NewResource("file:///a", "a")}, true},
+		{"resource differs", server.ServerResource{Resource: mcp.NewResource("file:///a", "a")}, server.ServerResource{Resource: mcp.NewResource("file:///a", "b")}, false},
+		{"same template", template("file:///{path}"), template("file:///{path}"), true},
+		{"template differs", template("file:///{path}"), template("file:///{name}"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got bool
+			switch a := tt.a.(type) {
+			case server.ServerTool:
+				got = sameDefinition(a, tt.b.(server.ServerTool))
+			case server.ServerPrompt:
+				got = sameDefinition(a, tt.b.(server.ServerPrompt))
+			case server.ServerResource:
+				got = sameDefinition(a, tt.b.(server.ServerResource))
+			case server.ServerResourceTemplate:
+				got = sameDefinition(a, tt.b.(server.ServerResourceTemplate))
+			}
+			if got != tt.want {
+				t.Errorf("sameDefinition = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncClientCollisions(t *testing.T) {
+	tests := []struct {
+		name      string
+		separator string
+		wantTools []string
+		wantErr   string
+	}{
+		{
+			name:      "route without namespace reports collision",
+			separator: "",
+			wantTools: []string{"search"},
+			wantErr:   "tool search from b conflicts with a",
+		},
+		{
+			name:      "aggregate namespaces avoid collision",
+			separator: "__",
+			wantTools: []string{"a__search", "b__search"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRegistry("test", tt.separator, server.NewMCPServer("test", "1"))
+			for _, name := range []string{"a", "b"} {
+				c := &Client{name: name, catalog: &catalog{tools: []mcp.Tool{mcp.NewTool("search")}}}
+				err := r.addClient(c)
+				if name == "a" && err != nil {
+					t.Fatalf("addClient(a) = %v", err)
+				}
+				if name == "b" {
+					if tt.wantErr == "" && err != nil {
+						t.Errorf("addClient(b) = %v", err)
+					}
+					if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+						t.Errorf("addClient(b) = %v, want %q", err, tt.wantErr)
+					}
+				}
+			}
+			if got := slices.Sorted(maps.Keys(r.tools)); !slices.Equal(got, tt.wantTools) {
+				t.Errorf("tools = %v, want %v", got, tt.wantTools)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+// relay.go 文件实现了后端发往客户端的请求的转发。
+// 后端发送的 sampling/createMessage、roots/list 和 elicitation/create 请求会被转发给发起调用的下游会话，
+// 下游会话的响应再返回给后端。按下游会话建立的连接只声明该会话的客户端支持的能力；
+// 共享的连接建立时无法知道之后由哪个会话发起调用，会声明所有未被拒绝的能力，收到请求时再检查下游会话是否支持。
+// SSE 传输的后端无法向代理发送请求，不会声明这些能力。
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// clientRequestTimeout 是等待下游会话响应转发的请求的最长时间，elicitation 需要等待用户输入
+const clientRequestTimeout = 10 * time.Minute
+
+// requestRelay 把一个后端连接收到的请求转发给下游会话，实现了 mcp-go 客户端的 sampling、roots 和 elicitation 处理接口
+type requestRelay struct {
+	client  *Client              // 后端客户端
+	session server.ClientSession // 连接所属的下游会话，共享的连接为 nil
+}
+
+// clientOptions 返回创建底层客户端时使用的选项，为需要声明的能力注册转发请求的处理函数
+// session 为连接所属的下游会话，共享的连接为 nil
+func (c *Client) clientOptions(session server.ClientSession) []client.ClientOption {
+	relay := &requestRelay{client: c, session: session}
+	var options []client.ClientOption
+	if relay.advertises(ClientRequestSampling) {
+		options = append(options, client.WithSamplingHandler(relay))
+	}
+	if relay.advertises(ClientRequestRoots) {
+		options = append(options, client.WithRootsHandler(relay))
+	}
+	if relay.advertises(ClientRequestElicitation) {
+		options = append(options, client.WithElicitationHandler(relay))
+	}
+	return options
+}
+
+// advertises 判断是否向后端声明请求类型对应的能力，按会话建立的连接还要求该会话的客户端支持
+func (r *requestRelay) advertises(kind ClientRequestType) bool {
+	if r.client.deniesRequest(kind) {
+		return false
+	}
+	return r.session == nil || sessionSupports(r.session, kind)
+}
+
+// deniesRequest 判断客户端选项是否拒绝转发该类型的请求
+func (c *Client) deniesRequest(kind ClientRequestType) bool {
+	options := c.currentOptions()
+	return options != nil && slices.Contains(options.DenyRequests, kind)
+}
+
+// sessionSupports 判断下游会话的客户端在初始化时是否声明了请求类型对应的能力
+func sessionSupports(session server.ClientSession, kind ClientRequestType) bool {
+	sessionWithInfo, ok := session.(server.SessionWithClientInfo)
+	if !ok {
+		return false
+	}
+	capabilities := sessionWithInfo.GetClientCapabilities()
+	switch kind {
+	case ClientRequestSampling:
+		return capabilities.Sampling != nil
+	case ClientRequestRoots:
+		return capabilities.Roots != nil
+	case ClientRequestElicitation:
+		return capabilities.Elicitation != nil
+	}
+	return false
+}
+
+// target 返回接收请求的下游会话，请求被拒绝或下游会话不支持时返回错误
+func (r *requestRelay) target(ctx context.Context, kind ClientRequestType) (server.ClientSession, error) {
+	// 选项在重新加载配置后可能发生变化，已声明的能力要到重连后才会更新，这里再检查一次
+	if r.client.deniesRequest(kind) {
+		return nil, fmt.Errorf("%s requests from %s are denied", kind, r.client.name)
+	}
+	session := r.session
+	if session == nil {
+		var err error
+		if session, err = r.client.originatingSession(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if !sessionSupports(session, kind) {
+		return nil, fmt.Errorf("the client of session %s does not support %s", session.SessionID(), kind)
+	}
+	log.Printf("<%s> Relaying %s request to session %s", r.client.name, kind, session.SessionID())
+	return session, nil
+}
+
+// CreateMessage 把后端的 sampling/createMessage 请求转发给下游会话
+func (r *requestRelay) CreateMessage(ctx context.Context, request mcp.CreateMessageRequest) (*mcp.CreateMessageResult, error) {
+	session, err := r.target(ctx, ClientRequestSampling)
+	if err != nil {
+		return nil, err
+	}
+	samplingSession, ok := session.(server.SessionWithSampling)
+	if !ok {
+		return nil, fmt.Errorf("session %s does not support sampling requests", session.SessionID())
+	}
+	ctx, cancel := context.WithTimeout(ctx, clientRequestTimeout)
+	defer cancel()
+	return samplingSession.RequestSampling(ctx, request)
+}
+
+// ListRoots 把后端的 roots/list 请求转发给下游会话
+func (r *requestRelay) ListRoots(ctx context.Context, request mcp.ListRootsRequest) (*mcp.ListRootsResult, error) {
+	session, err := r.target(ctx, ClientRequestRoots)
+	if err != nil {
+		return nil, err
+	}
+	rootsSession, ok := session.(server.SessionWithRoots)
+	if !ok {
+		return nil, fmt.Errorf("session %s does not support roots requests", session.SessionID())
+	}
+	ctx, cancel := context.WithTimeout(ctx, clientRequestTimeout)
+	defer cancel()
+	return rootsSession.ListRoots(ctx, request)
+}
+
+// Elicit 把后端的 elicitation/create 请求转发给下游会话
+func (r *requestRelay) Elicit(ctx context.Context, request mcp.ElicitationRequest) (*mcp.ElicitationResult, error) {
+	session, err := r.target(ctx, ClientRequestElicitation)
+	if err != nil {
+		return nil, err
+	}
+	elicitationSession, ok := session.(server.SessionWithElicitation)
+	if !ok {
+		return nil, fmt.Errorf("session %s does not support elicitation requests", session.SessionID())
+	}
+	ctx, cancel := context.WithTimeout(ctx, clientRequestTimeout)
+	defer cancel()
+	return elicitationSession.RequestElicitation(ctx, request)
+}
+
+// originatingSession 返回共享连接上收到的请求由哪个下游会话发起
+// 请求的上下文来自发起调用的请求时（例如 Streamable HTTP 后端在调用的响应流中发送请求）直接使用其中的会话，
+// 否则只有在恰好一个下游会话有进行中的调用时才能确定，无法确定时拒绝请求，避免把请求发送给错误的会话
+func (c *Client) originatingSession(ctx context.Context) (server.ClientSession, error) {
+	if session := server.ClientSessionFromContext(ctx); session != nil {
+		return session, nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var session server.ClientSession
+	for _, caller := range c.callers {
+		if session != nil && caller.SessionID() != session.SessionID() {
+			return nil, fmt.Errorf("cannot determine the originating session: several sessions have calls in flight on %s", c.name)
+		}
+		session = caller
+	}
+	if session == nil {
+		return nil, fmt.Errorf("no session has calls in flight on %s", c.name)
+	}
+	return session, nil
+}
+
+// addCaller 记录一个在共享连接上进行中的调用所属的下游会话，返回调用结束时需要调用的函数
+func (c *Client) addCaller(ctx context.Context) func() {
+	session := server.ClientSessionFromContext(ctx)
+	if session == nil || c.sessions != nil {
+		return func() {}
+	}
+	c.mu.Lock()
+	c.callers = append(c.callers, session)
+	c.mu.Unlock()
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if i := slices.Index(c.callers, session); i >= 0 {
+			c.callers = slices.Delete(c.callers, i, i+1)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// reload.go 文件负责触发配置热重载。
+// 代理总是会在收到 SIGHUP 信号时重新加载配置；此外可以监听本地配置文件的变化，
+// 或者定期重新拉取 http(s) 配置。新配置无效时会保留当前配置并记录错误。
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce 是配置文件变化后等待的时间，编辑器保存文件时通常会连续触发多个事件
+const watchDebounce = 500 * time.Millisecond
+
+// watchConfig 启动配置热重载的后台任务
+func watchConfig(ctx context.Context, p *proxy, conf *ReloadConfig) error {
+	triggers := make(chan string, 1)
+	trigger := func(reason string) {
+		select {
+		case triggers <- reason:
+		default:
+		}
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				signal.Stop(sigChan)
+				return
+			case <-sigChan:
+				trigger("SIGHUP received")
+			}
+		}
+	}()
+
+	if conf != nil {
+		if isRemoteConfig(p.configPath) {
+			if conf.PollInterval > 0 {
+				go pollConfig(ctx, time.Duration(conf.PollInterval), trigger)
+			}
+		} else if conf.Watch {
+			if err := watchConfigFile(ctx, p.configPath, trigger); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 所有触发源共用一个任务依次执行重新加载
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case reason := <-triggers:
+				// 轮询没有触发原因，避免每次轮询都输出日志
+				if reason != "" {
+					log.Printf("%s, reloading configuration", reason)
+				}
+				if err := p.reload(); err != nil {
+					log.Printf("Failed to reload configuration, keeping current one: %v", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// pollConfig 定期触发重新加载，配置没有变化时重新加载不会产生任何影响
+func pollConfig(ctx context.Context, interval time.Duration, trigger func(string)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			trigger("")
+		}
+	}
+}
+
+// watchConfigFile 监听本地配置文件的变化
+// 监听的是文件所在的目录而不是文件本身，这样编辑器以重命名方式保存、
+// 或者 Kubernetes ConfigMap 替换符号链接时也能收到事件
+func watchConfigFile(ctx context.Context, path string, trigger func(string)) error {
+	path = filepath.Clean(path)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err = watcher.Add(filepath.Dir(path)); err != nil {
+		_ = watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		debounce := time.NewTimer(watchDebounce)
+		debounce.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Base(event.Name) != filepath.Base(path) && filepath.Base(event.Name) != "..data" {
+					continue
+				}
+				if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Rename) {
+					debounce.Reset(watchDebounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Config watcher error: %v", err)
+			case <-debounce.C:
+				trigger("Config file changed")
+			}
+		}
+	}()
+	return nil
+}
+
+// isRemoteConfig 判断配置路径是否为 http(s) URL
+func isRemoteConfig(path string) bool {
+	u, err := url.Parse(path)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "http" || u.Scheme == "https"
+}
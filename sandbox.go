@@ -0,0 +1,86 @@
+// sandbox.go 文件负责创建 stdio 后端的子进程，并限制它的运行环境。
+// 子进程可以使用独立的工作目录、以其他用户身份运行、只继承允许的环境变量；
+// 配置了资源限制时，代理会以启动器的身份重新执行自身，设置资源限制后再执行后端的命令，
+// 这样资源限制在后端的命令开始运行之前就已经生效，并会被它启动的子进程继承。
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// sandboxCommand 是代理以启动器身份运行时的第一个参数
+const sandboxCommand = "__exec-stdio"
+
+// newStdioCommand 根据配置创建 stdio 后端的子进程，env 是配置中的环境变量
+func newStdioCommand(ctx context.Context, conf *StdioMCPClientConfig, command string, env []string, args []string) (*exec.Cmd, error) {
+	var cmd *exec.Cmd
+	if conf.Limits != nil && *conf.Limits != (ProcessLimits{}) {
+		// 启动器不会再查找命令，这里使用代理的 PATH 解析命令的路径，与不使用启动器时一致
+		path, err := exec.LookPath(command)
+		if err != nil {
+			return nil, err
+		}
+		self, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate proxy executable: %w", err)
+		}
+		limits, err := json.Marshal(conf.Limits)
+		if err != nil {
+			return nil, err
+		}
+		cmd = exec.CommandContext(ctx, self, append([]string{sandboxCommand, string(limits), path}, args...)...)
+	} else {
+		cmd = exec.CommandContext(ctx, command, args...)
+	}
+	cmd.Dir = conf.WorkingDir
+	cmd.Env = append(inheritedEnv(conf), env...)
+	if conf.UID != nil || conf.GID != nil {
+		if err := setCredential(cmd, conf.UID, conf.GID); err != nil {
+			return nil, err
+		}
+	}
+	return cmd, nil
+}
+
+// inheritedEnv 返回子进程从代理继承的环境变量，cleanEnv 时只继承 inheritEnv 中列出的变量
+func inheritedEnv(conf *StdioMCPClientConfig) []string {
+	if !conf.CleanEnv {
+		return os.Environ()
+	}
+	envs := make([]string, 0, len(conf.InheritEnv))
+	for _, name := range conf.InheritEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			envs = append(envs, name+"="+value)
+		}
+	}
+	return envs
+}
+
+// runSandbox 以启动器的身份设置资源限制，然后执行后端的命令，不会返回
+// 参数依次为 JSON 格式的资源限制、命令的路径和命令的参数
+func runSandbox(args []string) {
+	if len(args) < 2 {
+		sandboxFatal("usage: %s <limits> <command> [args...]", sandboxCommand)
+	}
+	var limits ProcessLimits
+	if err := json.Unmarshal([]byte(args[0]), &limits); err != nil {
+		sandboxFatal("invalid limits: %v", err)
+	}
+	if err := applyLimits(&limits); err != nil {
+		sandboxFatal("failed to set resource limits: %v", err)
+	}
+	if err := execCommand(args[1], args[1:]); err != nil {
+		sandboxFatal("failed to execute %s: %v", args[1], err)
+	}
+}
+
+// sandboxFatal 把错误写入标准错误输出并退出，代理会把它记录到后端的标准错误输出中
+func sandboxFatal(format string, args ...any) {
+	_, _ = fmt.Fprintln(os.Stderr, strings.TrimSpace(fmt.Sprintf(format, args...)))
+	os.Exit(127)
+}
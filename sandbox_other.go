@@ -0,0 +1,26 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// errSandboxUnsupported 表示当前平台不支持切换用户和资源限制
+var errSandboxUnsupported = errors.New("uid, gid and limits are only supported on Linux and macOS")
+
+// setCredential 在当前平台上不受支持
+func setCredential(*exec.Cmd, *uint32, *uint32) error {
+	return errSandboxUnsupported
+}
+
+// applyLimits 在当前平台上不受支持
+func applyLimits(*ProcessLimits) error {
+	return errSandboxUnsupported
+}
+
+// execCommand 在当前平台上不受支持
+func execCommand(string, []string) error {
+	return errSandboxUnsupported
+}
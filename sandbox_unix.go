@@ -0,0 +1,51 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setCredential 设置运行子进程的用户和组，未指定的一方沿用代理自身的 ID，切换用户需要代理以 root 身份运行
+func setCredential(cmd *exec.Cmd, uid, gid *uint32) error {
+	// Groups 为空，子进程不会保留代理的附加组
+	credential := &syscall.Credential{
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+	}
+	if uid != nil {
+		credential.Uid = *uid
+	}
+	if gid != nil {
+		credential.Gid = *gid
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+	return nil
+}
+
+// applyLimits 为当前进程设置资源限制，执行的命令会继承这些限制
+func applyLimits(limits *ProcessLimits) error {
+	for resource, value := range map[int]uint64{
+		unix.RLIMIT_CPU:    limits.CPUSeconds,
+		unix.RLIMIT_AS:     limits.AddressSpace,
+		unix.RLIMIT_NOFILE: limits.OpenFiles,
+		unix.RLIMIT_NPROC:  limits.Processes,
+	} {
+		if value == 0 {
+			continue
+		}
+		if err := unix.Setrlimit(resource, &unix.Rlimit{Cur: value, Max: value}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execCommand 用给定的命令替换当前进程
+func execCommand(path string, argv []string) error {
+	return unix.Exec(path, argv, os.Environ())
+}
@@ -0,0 +1,280 @@
+// session.go 文件实现了按下游会话建立的后端连接。
+// 需要把调用方的身份转发给后端，或者 stdio 后端按会话隔离时，每个下游会话使用独立的后端连接（或子进程），
+// 连接在第一次调用时建立，在下游会话结束、空闲超时或调用方的凭据变化后关闭。
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/client"
+)
+
+// sessionDialFunc 为一个下游会话建立并初始化后端连接
+type sessionDialFunc func(ctx context.Context) (*client.Client, *exec.Cmd, error)
+
+// sessionPool 管理一个后端的所有会话连接
+type sessionPool struct {
+	name        string        // 后端名称，用于日志
+	idleTimeout time.Duration // 会话连接的空闲超时时间
+	max         int           // 同时运行的进程的最大数量，0 表示不限制
+	killTimeout time.Duration // 关闭 stdio 子进程时等待其退出的时间
+	shared      func() bool   // 共享的进程是否在运行，它同样占用一个名额；为 nil 时不计入
+
+	mu       sync.Mutex
+	sessions map[string]*sessionConn // 下游会话 ID -> 会话连接
+	open     int                     // 占用名额的会话连接数量，包括正在建立的连接和已移除但尚未关闭的连接，连接关闭后才减少
+	closed   bool                    // 后端已关闭，不再建立新的连接
+}
+
+// sessionConn 是一个下游会话专属的后端连接
+type sessionConn struct {
+	key   string        // 建立连接时使用的参数摘要，变化时需要重新连接
+	ready chan struct{} // 连接建立完成（无论成功与否）时关闭
+
+	// 以下字段由 sessionPool.mu 保护，连接建立的结果在 ready 关闭之前写入
+	client   *client.Client
+	cmd      *exec.Cmd
+	err      error       // 建立连接失败的原因
+	inflight int         // 进行中的调用数量
+	freed    bool        // 占用的名额是否已经释放
+	retired  bool        // 已从连接池中移除，最后一个调用结束后关闭
+	lastUsed time.Time   // 最近一次调用结束的时间
+	timer    *time.Timer // 空闲超时定时器
+}
+
+// newSessionPool 创建会话连接池
+func newSessionPool(name string, idleTimeout time.Duration, max int, killTimeout time.Duration) *sessionPool {
+	return &sessionPool{
+		name:        name,
+		idleTimeout: idleTimeout,
+		max:         max,
+		killTimeout: killTimeout,
+		sessions:    make(map[string]*sessionConn),
+	}
+}
+
+// acquire 返回下游会话的后端连接，没有连接或 key 发生变化时使用 dial 建立新的连接
+// 调用结束后必须调用返回的 release 函数
+func (p *sessionPool) acquire(ctx context.Context, sessionID, key string, dial sessionDialFunc) (*client.Client, func(), error) {
+	// 共享进程的状态由客户端的锁保护，在持有 p.mu 之前读取
+	shared := 0
+	if p.shared != nil && p.shared() {
+		shared = 1
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, nil, fmt.Errorf("backend %s is shutting down", p.name)
+	}
+	conn := p.sessions[sessionID]
+	if conn != nil && conn.key != key {
+		// 调用方的凭据变化了，旧连接在进行中的调用结束后关闭
+		log.Printf("<%s> Forwarded credentials changed for session %s, reconnecting", p.name, sessionID)
+		p.retireLocked(sessionID, conn)
+		conn = nil
+	}
+	created := conn == nil
+	if created {
+		if p.max > 0 && p.open+shared >= p.max {
+			p.mu.Unlock()
+			return nil, nil, fmt.Errorf("backend %s has reached the limit of %d processes", p.name, p.max)
+		}
+		conn = &sessionConn{key: key, ready: make(chan struct{})}
+		p.sessions[sessionID] = conn
+		p.open++
+	}
+	conn.inflight++
+	if conn.timer != nil {
+		conn.timer.Stop()
+	}
+	p.mu.Unlock()
+
+	release := func() { p.release(sessionID, conn) }
+	if created {
+		// 连接的生命周期跟随下游会话，而不是触发建立连接的这一次调用
+		mcpClient, cmd, err := dial(context.WithoutCancel(ctx))
+		p.mu.Lock()
+		conn.client, conn.cmd, conn.err = mcpClient, cmd, err
+		p.mu.Unlock()
+		close(conn.ready)
+		if err == nil {
+			log.Printf("<%s> Opened connection for session %s", p.name, sessionID)
+		}
+	} else {
+		select {
+		case <-conn.ready:
+		case <-ctx.Done():
+			release()
+			return nil, nil, ctx.Err()
+		}
+	}
+	// ready 关闭之后连接建立的结果不再变化
+	if conn.err != nil {
+		release()
+		return nil, nil, conn.err
+	}
+	return conn.client, release, nil
+}
+
+// release 结束一次调用，连接已被移除时在最后一个调用结束后关闭它，否则开始计算空闲时间
+func (p *sessionPool) release(sessionID string, conn *sessionConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn.inflight--
+	if conn.err != nil {
+		// 建立失败的连接不保留，下一次调用会重新建立；没有进程在运行，名额立即释放
+		p.removeLocked(sessionID, conn)
+		p.freeLocked(conn)
+		return
+	}
+	if conn.retired {
+		p.closeIfIdleLocked(conn)
+		return
+	}
+	conn.lastUsed = time.Now()
+	if conn.inflight == 0 {
+		if conn.timer == nil {
+			conn.timer = time.AfterFunc(p.idleTimeout, func() { p.expire(sessionID, conn) })
+		} else {
+			conn.timer.Reset(p.idleTimeout)
+		}
+	}
+}
+
+// expire 关闭空闲超时的连接
+func (p *sessionPool) expire(sessionID string, conn *sessionConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if conn.retired || conn.inflight > 0 || time.Since(conn.lastUsed) < p.idleTimeout {
+		return
+	}
+	log.Printf("<%s> Closing idle connection for session %s", p.name, sessionID)
+	p.retireLocked(sessionID, conn)
+}
+
+// drop 移除连接断开的会话连接，下一次调用会重新建立
+func (p *sessionPool) drop(sessionID string, mcpClient *client.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if conn := p.sessions[sessionID]; conn != nil && conn.client == mcpClient {
+		log.Printf("<%s> Lost connection for session %s", p.name, sessionID)
+		p.retireLocked(sessionID, conn)
+	}
+}
+
+// closeSession 在下游会话结束时关闭它的后端连接
+func (p *sessionPool) closeSession(sessionID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if conn := p.sessions[sessionID]; conn != nil {
+		log.Printf("<%s> Closing connection for ended session %s", p.name, sessionID)
+		p.retireLocked(sessionID, conn)
+	}
+}
+
+// close 关闭所有会话连接，之后不再建立新的连接
+func (p *sessionPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for sessionID, conn := range p.sessions {
+		p.retireLocked(sessionID, conn)
+	}
+}
+
+// retireLocked 从连接池中移除连接，没有进行中的调用时立即关闭，调用方需要持有 p.mu
+func (p *sessionPool) retireLocked(sessionID string, conn *sessionConn) {
+	p.removeLocked(sessionID, conn)
+	conn.retired = true
+	if conn.timer != nil {
+		conn.timer.Stop()
+	}
+	p.closeIfIdleLocked(conn)
+}
+
+// removeLocked 从连接池中移除连接，调用方需要持有 p.mu
+// 移除的连接仍然占用名额，直到它的进程退出，进行中的调用会让进程继续运行
+func (p *sessionPool) removeLocked(sessionID string, conn *sessionConn) {
+	if p.sessions[sessionID] == conn {
+		delete(p.sessions, sessionID)
+	}
+}
+
+// freeLocked 释放连接占用的名额，每个连接只释放一次，调用方需要持有 p.mu
+func (p *sessionPool) freeLocked(conn *sessionConn) {
+	if !conn.freed {
+		conn.freed = true
+		p.open--
+	}
+}
+
+// closeIfIdleLocked 在已移除的连接没有进行中的调用时关闭它，关闭完成后释放名额，调用方需要持有 p.mu
+func (p *sessionPool) closeIfIdleLocked(conn *sessionConn) {
+	if conn.inflight > 0 {
+		return
+	}
+	select {
+	case <-conn.ready:
+		if conn.client == nil {
+			p.freeLocked(conn)
+			return
+		}
+	default:
+	}
+	go func() {
+		// 仍在建立的连接等待建立完成后再关闭
+		<-conn.ready
+		if conn.client != nil {
+			_ = closeMCPClient(conn.client, conn.cmd, p.killTimeout)
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.freeLocked(conn)
+	}()
+}
+
+// lookup 返回下游会话已建立的连接，没有连接或连接尚未建立完成时返回 nil
+func (p *sessionPool) lookup(sessionID string) *client.Client {
+	p.mu.Lock()
+	conn := p.sessions[sessionID]
+	p.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	select {
+	case <-conn.ready:
+		return conn.client
+	default:
+		return nil
+	}
+}
+
+// sessionOf 返回连接所属的下游会话
+func (p *sessionPool) sessionOf(mcpClient *client.Client) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for sessionID, conn := range p.sessions {
+		if conn.client == mcpClient {
+			return sessionID, true
+		}
+	}
+	return "", false
+}
+
+// count 返回占用名额的会话连接数量，包括已移除但进程尚未退出的连接
+func (p *sessionPool) count() int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.open
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/client"
+)
+
+// countingDial 返回记录调用次数的 dial 函数，err 不为 nil 时建立连接失败
+func countingDial(dials *atomic.Int32, err error) sessionDialFunc {
+	return func(context.Context) (*client.Client, *exec.Cmd, error) {
+		dials.Add(1)
+		return nil, nil, err
+	}
+}
+
+func TestSessionPoolLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		free    func(p *sessionPool, release func())
+		wantErr bool
+	}{
+		{
+			name:    "limit reached",
+			free:    func(*sessionPool, func()) {},
+			wantErr: true,
+		},
+		{
+			name: "slot freed when the session ends",
+			free: func(p *sessionPool, release func()) {
+				release()
+				p.closeSession("s1")
+			},
+		},
+		{
+			name: "slot freed when the session ends during a call",
+			free: func(p *sessionPool, release func()) {
+				p.closeSession("s1")
+				defer release()
+			},
+		},
+		{
+			name: "slot freed when the connection is lost",
+			free: func(p *sessionPool, release func()) {
+				release()
+				p.drop("s1", nil)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dials atomic.Int32
+			p := newSessionPool("test", time.Hour, 1, time.Second)
+			defer p.close()
+			_, release, err := p.acquire(context.Background(), "s1", "", countingDial(&dials, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.free(p, release)
+			_, release2, err := p.acquire(context.Background(), "s2", "", countingDial(&dials, nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("acquire(s2) error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), "limit of 1 processes") {
+					t.Errorf("acquire(s2) error = %v", err)
+				}
+				return
+			}
+			release2()
+			if got := p.count(); got != 1 {
+				t.Errorf("count = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestSessionPoolReuse(t *testing.T) {
+	tests := []struct {
+		name      string
+		idle      time.Duration
+		wait      time.Duration
+		firstKey  string
+		secondKey string
+		dialErr   error
+		wantDials int32
+	}{
+		{"reused within idle timeout", time.Hour, 0, "k", "k", nil, 1},
+		{"reaped after idle timeout", 10 * time.Millisecond, 100 * time.Millisecond, "k", "k", nil, 2},
+		{"reconnected when credentials change", time.Hour, 0, "k1", "k2", nil, 2},
+		{"failed connection is not kept", time.Hour, 0, "k", "k", errors.New("boom"), 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dials atomic.Int32
+			p := newSessionPool("test", tt.idle, 1, time.Second)
+			defer p.close()
+			for i, key := range []string{tt.firstKey, tt.secondKey} {
+				_, release, err := p.acquire(context.Background(), "s1", key, countingDial(&dials, tt.dialErr))
+				if (err != nil) != (tt.dialErr != nil) {
+					t.Fatalf("acquire #%d error = %v", i, err)
+				}
+				if err == nil {
+					release()
+				}
+				time.Sleep(tt.wait)
+			}
+			if got := dials.Load(); got != tt.wantDials {
+				t.Errorf("dials = %d, want %d", got, tt.wantDials)
+			}
+			wantCount := 1
+			if tt.dialErr != nil || tt.wait > tt.idle {
+				wantCount = 0
+			}
+			if got := p.count(); got != wantCount {
+				t.Errorf("count = %d, want %d", got, wantCount)
+			}
+		})
+	}
+}
+
+// closingTransport 是关闭时等待 exited 被关闭的后端传输层，模拟退出较慢的进程
+type closingTransport struct {
+	fakeTransport
+	exited chan struct{}
+}
+
+func (t *closingTransport) Close() error {
+	<-t.exited
+	return nil
+}
+
+// processDial 返回建立连接成功的 dial 函数，关闭 exited 之前连接的关闭不会完成
+func processDial(exited chan struct{}) sessionDialFunc {
+	return func(context.Context) (*client.Client, *exec.Cmd, error) {
+		return client.NewClient(&closingTransport{exited: exited}), nil, nil
+	}
+}
+
+// waitCount 等待连接池占用的名额变为 want
+func waitCount(t *testing.T, p *sessionPool, want int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for p.count() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("count = %d, want %d", p.count(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSessionPoolCountsRunningProcesses(t *testing.T) {
+	tests := []struct {
+		name string
+		// end 结束会话 s1 的连接，返回之后它的进程仍在运行
+		end func(p *sessionPool, release func())
+		// finish 让会话 s1 的进程退出
+		finish func(exited chan struct{}, release func())
+	}{
+		{
+			name: "session ends during a call",
+			end: func(p *sessionPool, release func()) {
+				p.closeSession("s1")
+			},
+			finish: func(exited chan struct{}, release func()) {
+				close(exited)
+				release()
+			},
+		},
+		{
+			name: "process is slow to exit",
+			end: func(p *sessionPool, release func()) {
+				release()
+				p.closeSession("s1")
+			},
+			finish: func(exited chan struct{}, release func()) {
+				close(exited)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exited := make(chan struct{})
+			p := newSessionPool("test", time.Hour, 1, time.Second)
+			defer p.close()
+			_, release, err := p.acquire(context.Background(), "s1", "", processDial(exited))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.end(p, release)
+			if _, _, err = p.acquire(context.Background(), "s2", "", processDial(exited)); err == nil {
+				t.Fatal("acquire(s2) succeeded while the old process is still running")
+			}
+			tt.finish(exited, release)
+			waitCount(t, p, 0)
+			_, release2, err := p.acquire(context.Background(), "s2", "", processDial(exited))
+			if err != nil {
+				t.Fatalf("acquire(s2) after the old process exited: %v", err)
+			}
+			release2()
+		})
+	}
+}
+
+func TestSessionPoolCountsSharedProcess(t *testing.T) {
+	tests := []struct {
+		name    string
+		shared  bool
+		wantErr bool
+	}{
+		{name: "shared process running", shared: true, wantErr: true},
+		{name: "shared process stopped", shared: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dials atomic.Int32
+			p := newSessionPool("test", time.Hour, 2, time.Second)
+			p.shared = func() bool { return tt.shared }
+			defer p.close()
+			_, release, err := p.acquire(context.Background(), "s1", "", countingDial(&dials, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer release()
+			_, release2, err := p.acquire(context.Background(), "s2", "", countingDial(&dials, nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("acquire(s2) error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				release2()
+			}
+		})
+	}
+}
+
+func TestSessionPoolConcurrentAccess(t *testing.T) {
+	p := newSessionPool("test", time.Hour, 0, time.Second)
+	exited := make(chan struct{})
+	close(exited)
+	dial := func(ctx context.Context) (*client.Client, *exec.Cmd, error) {
+		// 模拟建立连接时的初始化握手，期间日志转发可能查找连接所属的会话
+		time.Sleep(time.Millisecond)
+		return processDial(exited)(ctx)
+	}
+	stop := make(chan struct{})
+	var forwarding sync.WaitGroup
+	forwarding.Add(1)
+	go func() {
+		defer forwarding.Done()
+		other := client.NewClient(&fakeTransport{})
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, _ = p.sessionOf(other)
+			_ = p.lookup("s0")
+			p.drop("s1", other)
+		}
+	}()
+
+	var calls sync.WaitGroup
+	for i := range 20 {
+		sessionID := fmt.Sprintf("s%d", i%4)
+		calls.Add(1)
+		go func() {
+			defer calls.Done()
+			// 部分调用在连接建立完成之前放弃等待
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(i%3)*time.Millisecond)
+			defer cancel()
+			mcpClient, release, err := p.acquire(ctx, sessionID, "", dial)
+			if err != nil {
+				return
+			}
+			if got, ok := p.sessionOf(mcpClient); ok && got != sessionID {
+				t.Errorf("sessionOf = %q, want %q", got, sessionID)
+			}
+			release()
+		}()
+	}
+	calls.Wait()
+	close(stop)
+	forwarding.Wait()
+	p.close()
+	waitCount(t, p, 0)
+}
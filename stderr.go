@@ -0,0 +1,151 @@
+// stderr.go 文件负责收集 stdio 后端的标准错误输出。
+// 子进程的标准错误输出按行读取，输出到代理的日志（以 <name> 为前缀），可以同时写入按大小轮转的文件；
+// 最近的若干行保留在内存中，后端崩溃后可以通过管理接口查看。
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// maxStderrLineLength 是单行标准错误输出的最大长度，超出的部分会被丢弃
+const maxStderrLineLength = 64 * 1024
+
+// StderrLine 是一行标准错误输出
+type StderrLine struct {
+	Time time.Time `json:"time"` // 读取到该行的时间
+	Text string    `json:"text"` // 该行的内容，不包含换行符
+}
+
+// stderrLog 收集一个后端所有子进程的标准错误输出
+type stderrLog struct {
+	name string             // 后端名称，用于日志前缀
+	log  bool               // 是否输出到代理的日志
+	out  *lumberjack.Logger // 写入的文件，未配置时为 nil
+
+	mu    sync.Mutex
+	lines []StderrLine // 最近的若干行，作为环形缓冲区使用
+	next  int          // 下一行写入的位置
+}
+
+// newStderrLog 根据配置创建标准错误输出的收集器
+func newStderrLog(name string, conf *StderrConfig) *stderrLog {
+	s := &stderrLog{
+		name:  name,
+		log:   conf.Log.OrElse(true),
+		lines: make([]StderrLine, 0, conf.Lines),
+	}
+	if conf.File != "" {
+		s.out = &lumberjack.Logger{
+			Filename:   conf.File,
+			MaxSize:    conf.MaxSize,
+			MaxBackups: conf.MaxBackups,
+			MaxAge:     conf.MaxAge,
+			Compress:   conf.Compress,
+		}
+	}
+	return s
+}
+
+// capture 按行读取子进程的标准错误输出，直到管道被关闭
+// 必须持续读取，否则管道写满后子进程会阻塞在写入标准错误输出上
+func (s *stderrLog) capture(r io.Reader) {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := readStderrLine(reader)
+		if line != "" || err == nil {
+			s.write(line)
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrClosed) {
+				log.Printf("<%s> Stopped reading stderr: %v", s.name, err)
+			}
+			return
+		}
+	}
+}
+
+// readStderrLine 读取一行，超过最大长度的部分会被丢弃
+func readStderrLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		fragment, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			return string(line), err
+		}
+		if room := maxStderrLineLength - len(line); room > 0 {
+			line = append(line, fragment[:min(len(fragment), room)]...)
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// write 记录一行标准错误输出
+func (s *stderrLog) write(text string) {
+	line := StderrLine{Time: time.Now(), Text: text}
+	if s.log {
+		log.Printf("<%s> stderr: %s", s.name, text)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.out != nil {
+		if _, err := fmt.Fprintf(s.out, "%s %s\n", line.Time.Format(time.RFC3339Nano), text); err != nil {
+			log.Printf("<%s> Failed to write stderr file: %v", s.name, err)
+		}
+	}
+	if cap(s.lines) == 0 {
+		return
+	}
+	if len(s.lines) < cap(s.lines) {
+		s.lines = append(s.lines, line)
+	} else {
+		s.lines[s.next] = line
+	}
+	s.next = (s.next + 1) % cap(s.lines)
+}
+
+// tail 按时间顺序返回最近的 n 行，n 不大于 0 时返回保留的所有行
+func (s *stderrLog) tail(n int) []StderrLine {
+	if s == nil {
+		return []StderrLine{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ordered := make([]StderrLine, 0, len(s.lines))
+	if len(s.lines) < cap(s.lines) {
+		ordered = append(ordered, s.lines...)
+	} else {
+		ordered = append(ordered, s.lines[s.next:]...)
+		ordered = append(ordered, s.lines[:s.next]...)
+	}
+	if n > 0 && n < len(ordered) {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return ordered
+}
+
+// Close 关闭写入的文件，之后仍在退出的子进程的输出不会再写入文件
+func (s *stderrLog) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.out == nil {
+		return nil
+	}
+	out := s.out
+	s.out = nil
+	return out.Close()
+}
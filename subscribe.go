@@ -0,0 +1,418 @@
+// subscribe.go 文件实现了资源订阅的转发。
+// 下游会话的 resources/subscribe 和 resources/unsubscribe 会被转发给资源所属的后端，
+// 同一个资源无论被多少个会话订阅，后端都只会收到一次订阅，最后一个订阅的会话取消订阅或结束时才取消后端的订阅；
+// 后端发送的 notifications/resources/updated 只会转发给订阅了该资源的会话。
+// 订阅总是发送到共享的底层客户端，重连后会重新订阅，按需启动的后端在有订阅时不会因空闲而停止。
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	unsubscribeTimeout = 10 * time.Second // 下游会话结束时取消后端订阅以及重连后重新订阅的超时时间
+	// maxSubscriptionRequestSize 是判断请求是否为订阅请求时最多读取的字节数，超过的请求直接交给 mcp-go 处理
+	maxSubscriptionRequestSize = 64 << 10
+)
+
+// 资源订阅的方法名称，mcp-go 没有为它们定义常量
+const (
+	methodResourcesSubscribe   mcp.MCPMethod = "resources/subscribe"
+	methodResourcesUnsubscribe mcp.MCPMethod = "resources/unsubscribe"
+)
+
+var (
+	errBatchSubscription = errors.New("resources/subscribe and resources/unsubscribe are not supported in batch requests")
+	errResourceNotFound  = errors.New("resource not found")
+)
+
+// subscriber 是订阅了资源的一个下游会话
+type subscriber struct {
+	server    *server.MCPServer // 会话所属的 MCP 服务器
+	sessionID string            // 下游会话 ID
+}
+
+// subscriptionRequest 是下游会话的订阅或取消订阅请求
+type subscriptionRequest struct {
+	ID     *mcp.RequestId `json:"id"`
+	Method mcp.MCPMethod  `json:"method"`
+	Params struct {
+		URI string `json:"uri"`
+	} `json:"params"`
+}
+
+// isSubscription 判断消息是否为订阅或取消订阅请求，同名的通知不算
+func (r *subscriptionRequest) isSubscription() bool {
+	return r.ID != nil && (r.Method == methodResourcesSubscribe || r.Method == methodResourcesUnsubscribe)
+}
+
+// interceptSubscriptions 直接处理发送到消息端点的订阅和取消订阅请求，其他请求交给 next
+// mcp-go 的服务器不处理这两个方法，也没有注册自定义方法的扩展点，所以在 HTTP 层按传输方式返回响应：
+// Streamable HTTP 在 POST 的响应中返回结果，SSE 先返回 202，再通过会话的事件流发送结果。
+// 请求体最多读取 maxSubscriptionRequestSize 字节，更大的请求不会被整个缓存，拼接回请求体后交给 next。
+// 直接处理的请求不经过 MCP 服务器的钩子，授权和审计在 subscribe 中完成，服务端 span 在这里结束
+func (s *Server) interceptSubscriptions(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var sessionID string
+		switch {
+		case r.Method != http.MethodPost || r.Body == nil:
+			next.ServeHTTP(w, r)
+			return
+		case s.streamableHTTPServer != nil && r.URL.Path == route+"mcp":
+			sessionID = r.Header.Get(server.HeaderKeySessionID)
+		case s.sseServer != nil && r.URL.Path == s.sseServer.CompleteMessagePath():
+			sessionID = r.URL.Query().Get("sessionId")
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxSubscriptionRequestSize+1))
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if len(body) > maxSubscriptionRequestSize {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			next.ServeHTTP(w, r)
+			return
+		}
+		request, err := parseSubscriptionRequest(body)
+		if err != nil {
+			writeJSONRPCMessage(w, http.StatusBadRequest, mcp.NewJSONRPCError(mcp.NewRequestId(nil), mcp.INVALID_REQUEST, err.Error(), nil))
+			return
+		}
+		if request == nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !s.hasSession(sessionID) {
+			writeJSONRPCMessage(w, http.StatusNotFound, mcp.NewJSONRPCError(*request.ID, mcp.INVALID_PARAMS, "Invalid session ID", nil))
+			return
+		}
+		response := s.handleSubscription(r.Context(), sessionID, request)
+		span := trace.SpanFromContext(r.Context())
+		if failure, ok := response.(mcp.JSONRPCError); ok {
+			span.SetStatus(codes.Error, failure.Error.Message)
+		}
+		if r.URL.Path == route+"mcp" {
+			writeJSONRPCMessage(w, http.StatusOK, response)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		if err := s.sseServer.SendEventToSession(sessionID, response); err != nil {
+			log.Printf("Failed to send %s response to session %s: %v", request.Method, sessionID, err)
+		}
+		// SSE 返回 202 时 tracingMiddleware 不会结束带 id 的请求的 span，而是交给 MCP 服务器的钩子
+		span.End()
+	})
+}
+
+// parseSubscriptionRequest 解析订阅或取消订阅请求，不是这两种请求时返回 nil
+// mcp-go 的两种传输都不支持批量请求，批量请求中包含订阅或取消订阅请求时返回错误，其余的批量请求交给 mcp-go 拒绝
+func parseSubscriptionRequest(body []byte) (*subscriptionRequest, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []subscriptionRequest
+		if err := json.Unmarshal(body, &batch); err == nil && slices.ContainsFunc(batch, func(r subscriptionRequest) bool { return r.isSubscription() }) {
+			return nil, errBatchSubscription
+		}
+		return nil, nil
+	}
+	var request subscriptionRequest
+	if err := json.Unmarshal(body, &request); err != nil || !request.isSubscription() {
+		return nil, nil
+	}
+	return &request, nil
+}
+
+// writeJSONRPCMessage 把 JSON-RPC 消息作为 HTTP 响应写出
+func writeJSONRPCMessage(w http.ResponseWriter, status int, message mcp.JSONRPCMessage) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(message)
+}
+
+// handleSubscription 处理下游会话的订阅或取消订阅请求，返回要发送给会话的响应
+func (s *Server) handleSubscription(ctx context.Context, sessionID string, request *subscriptionRequest) mcp.JSONRPCMessage {
+	uri := request.Params.URI
+	if uri == "" {
+		return mcp.NewJSONRPCError(*request.ID, mcp.INVALID_PARAMS, "uri is required", nil)
+	}
+	var err error
+	if request.Method == methodResourcesUnsubscribe {
+		err = s.unsubscribe(ctx, sessionID, uri)
+	} else {
+		err = s.subscribe(ctx, sessionID, uri)
+	}
+	switch {
+	case errors.Is(err, errResourceNotFound):
+		return mcp.NewJSONRPCError(*request.ID, mcp.RESOURCE_NOT_FOUND, err.Error(), nil)
+	case err != nil:
+		return mcp.NewJSONRPCError(*request.ID, mcp.INTERNAL_ERROR, err.Error(), nil)
+	}
+	return mcp.NewJSONRPCResultResponse(*request.ID, mcp.EmptyResult{})
+}
+
+// openSubscriptions 记录新注册的下游会话，只有已注册的会话可以订阅资源
+func (s *Server) openSubscriptions(sessionID string) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]struct{})
+	}
+	s.sessions[sessionID] = struct{}{}
+}
+
+// hasSession 判断下游会话是否已注册且尚未结束
+func (s *Server) hasSession(sessionID string) bool {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	_, ok := s.sessions[sessionID]
+	return ok
+}
+
+// subscribe 为下游会话订阅资源，已经订阅过时直接返回
+// 先检查调用方能否访问资源所属的后端，被拒绝的订阅同样会记录到审计日志中；
+// 转发给后端时不持有 s.subMu，完成后再检查会话是否仍然存在，会话已结束时撤销刚刚的订阅
+func (s *Server) subscribe(ctx context.Context, sessionID, uri string) (err error) {
+	s.subMu.Lock()
+	_, exists := s.subscriptions[sessionID][uri]
+	s.subMu.Unlock()
+	if exists {
+		return nil
+	}
+	c, ok := s.resourceOwner(uri)
+	if !ok {
+		return fmt.Errorf("%w: %s", errResourceNotFound, uri)
+	}
+	record := AuditRecord{
+		Timestamp: time.Now(),
+		Backend:   c.name,
+		Method:    string(methodResourcesSubscribe),
+		URI:       uri,
+		Session:   sessionID,
+	}
+	defer func() {
+		if c.audit.enabled(true) {
+			c.audit.write(ctx, record, nil, err)
+		}
+	}()
+	if err = authorizeServer(ctx, c.name); err != nil {
+		return err
+	}
+	sub := subscriber{server: s.mcpServer, sessionID: sessionID}
+	if err = c.subscribe(ctx, uri, sub); err != nil {
+		return err
+	}
+
+	s.subMu.Lock()
+	if _, open := s.sessions[sessionID]; !open {
+		s.subMu.Unlock()
+		if err := c.unsubscribe(ctx, uri, sub, true); err != nil {
+			log.Printf("<%s> Failed to unsubscribe from %s: %v", c.name, uri, err)
+		}
+		return errSessionClosed
+	}
+	defer s.subMu.Unlock()
+	if s.subscriptions == nil {
+		s.subscriptions = make(map[string]map[string]*Client)
+	}
+	if s.subscriptions[sessionID] == nil {
+		s.subscriptions[sessionID] = make(map[string]*Client)
+	}
+	// 并发的重复订阅在后端只记录一次，这里覆盖为同一个后端即可
+	s.subscriptions[sessionID][uri] = c
+	return nil
+}
+
+// unsubscribe 取消下游会话对资源的订阅，没有订阅时直接返回
+// 取消订阅只会减少会话收到的通知，所以不检查授权作用域，但同样会记录到审计日志中；
+// 转发给后端时不持有 s.subMu，后端取消成功后才移除记录，失败时会话仍然保持订阅
+func (s *Server) unsubscribe(ctx context.Context, sessionID, uri string) error {
+	s.subMu.Lock()
+	c, exists := s.subscriptions[sessionID][uri]
+	s.subMu.Unlock()
+	if !exists {
+		return nil
+	}
+	record := AuditRecord{
+		Timestamp: time.Now(),
+		Backend:   c.name,
+		Method:    string(methodResourcesUnsubscribe),
+		URI:       uri,
+		Session:   sessionID,
+	}
+	err := c.unsubscribe(ctx, uri, subscriber{server: s.mcpServer, sessionID: sessionID}, false)
+	if c.audit.enabled(true) {
+		c.audit.write(ctx, record, nil, err)
+	}
+	if err != nil {
+		return err
+	}
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	if s.subscriptions[sessionID][uri] == c {
+		delete(s.subscriptions[sessionID], uri)
+	}
+	return nil
+}
+
+// closeSubscriptions 在下游会话结束时取消它的所有订阅
+func (s *Server) closeSubscriptions(sessionID string) {
+	s.subMu.Lock()
+	subscriptions := s.subscriptions[sessionID]
+	delete(s.subscriptions, sessionID)
+	delete(s.sessions, sessionID)
+	s.subMu.Unlock()
+	if len(subscriptions) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), unsubscribeTimeout)
+	defer cancel()
+	sub := subscriber{server: s.mcpServer, sessionID: sessionID}
+	for uri, c := range subscriptions {
+		if err := c.unsubscribe(ctx, uri, sub, true); err != nil {
+			log.Printf("<%s> Failed to unsubscribe from %s: %v", c.name, uri, err)
+		}
+	}
+}
+
+// subscribe 为下游会话订阅资源，资源第一次被订阅时才发送到后端，同一个会话重复订阅只记录一次
+func (c *Client) subscribe(ctx context.Context, uri string, sub subscriber) error {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	c.mu.RLock()
+	subscribers := c.subscribers[uri]
+	c.mu.RUnlock()
+	if slices.Contains(subscribers, sub) {
+		return nil
+	}
+	if len(subscribers) == 0 {
+		mcpClient, release, err := c.sharedClient(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		if err = c.forwardSubscription(ctx, mcpClient, methodResourcesSubscribe, uri); err != nil {
+			return err
+		}
+		log.Printf("<%s> Subscribed to %s", c.name, uri)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subscribers == nil {
+		c.subscribers = make(map[string][]subscriber)
+	}
+	c.subscribers[uri] = append(c.subscribers[uri], sub)
+	return nil
+}
+
+// unsubscribe 取消下游会话对资源的订阅，最后一个会话取消订阅时才取消后端的订阅
+// 后端取消失败时保留记录并返回错误；closing 为 true 表示会话已经结束，此时无论后端是否成功都会移除记录
+// 后端当前没有连接时只移除记录，重连时不会再订阅该资源
+func (c *Client) unsubscribe(ctx context.Context, uri string, sub subscriber, closing bool) error {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	c.mu.RLock()
+	subscribers := c.subscribers[uri]
+	mcpClient := c.client
+	c.mu.RUnlock()
+	if !slices.Contains(subscribers, sub) {
+		return nil
+	}
+	var err error
+	if len(subscribers) == 1 && mcpClient != nil {
+		if err = c.forwardSubscription(ctx, mcpClient, methodResourcesUnsubscribe, uri); err == nil {
+			log.Printf("<%s> Unsubscribed from %s", c.name, uri)
+		} else if !closing {
+			return err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscribers[uri] = slices.DeleteFunc(c.subscribers[uri], func(s subscriber) bool { return s == sub })
+	if len(c.subscribers[uri]) == 0 {
+		delete(c.subscribers, uri)
+	}
+	return err
+}
+
+// forwardSubscription 把订阅或取消订阅请求发送到后端，和其他转发的调用一样记录客户端 span 和耗时
+func (c *Client) forwardSubscription(ctx context.Context, mcpClient *client.Client, method mcp.MCPMethod, uri string) error {
+	ctx, span := startBackendSpan(ctx, c.name, string(method))
+	start := time.Now()
+	var err error
+	if method == methodResourcesUnsubscribe {
+		err = mcpClient.Unsubscribe(ctx, mcp.UnsubscribeRequest{Params: mcp.UnsubscribeParams{URI: uri}})
+	} else {
+		err = mcpClient.Subscribe(ctx, mcp.SubscribeRequest{Params: mcp.SubscribeParams{URI: uri}})
+	}
+	backendCallDuration.WithLabelValues(c.name, string(method)).Observe(time.Since(start).Seconds())
+	endSpan(span, err)
+	return err
+}
+
+// hasSubscriptions 判断是否有下游会话订阅了后端的资源
+func (c *Client) hasSubscriptions() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.subscribers) > 0
+}
+
+// resubscribe 在重连后使用新的底层客户端重新订阅所有仍有会话订阅的资源
+func (c *Client) resubscribe(mcpClient *client.Client) {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	c.mu.RLock()
+	uris := make([]string, 0, len(c.subscribers))
+	for uri := range c.subscribers {
+		uris = append(uris, uri)
+	}
+	c.mu.RUnlock()
+	for _, uri := range uris {
+		ctx, cancel := context.WithTimeout(c.ctx, unsubscribeTimeout)
+		err := c.forwardSubscription(ctx, mcpClient, methodResourcesSubscribe, uri)
+		cancel()
+		if err != nil {
+			log.Printf("<%s> Failed to resubscribe to %s: %v", c.name, uri, err)
+		}
+	}
+}
+
+// resourceUpdated 把后端的资源更新通知转发给订阅了该资源的下游会话
+func (c *Client) resourceUpdated(mcpClient *client.Client, notification mcp.JSONRPCNotification) {
+	uri, _ := notification.Params.AdditionalFields["uri"].(string)
+	c.mu.RLock()
+	current := c.client == mcpClient
+	subscribers := slices.Clone(c.subscribers[uri])
+	c.mu.RUnlock()
+	if !current {
+		return
+	}
+	for _, sub := range subscribers {
+		if err := sub.server.SendNotificationToSpecificClient(sub.sessionID, notification.Method, notification.Params.AdditionalFields); err != nil {
+			log.Printf("<%s> Failed to forward %s to session %s: %v", c.name, notification.Method, sub.sessionID, err)
+		}
+	}
+}
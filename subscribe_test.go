@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/client/transport"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// fakeTransport 是记录订阅请求的后端传输层，fail 中的方法会返回错误
+type fakeTransport struct {
+	mu    sync.Mutex
+	calls []string
+	fail  map[string]bool
+}
+
+func (f *fakeTransport) Start(context.Context) error { return nil }
+
+func (f *fakeTransport) SendRequest(ctx context.Context, request transport.JSONRPCRequest) (*transport.JSONRPCResponse, error) {
+	response := &transport.JSONRPCResponse{JSONRPC: mcp.JSONRPC_VERSION, ID: request.ID, Result: json.RawMessage("{}")}
+	if request.Method == string(mcp.MethodInitialize) {
+		result, err := json.Marshal(mcp.InitializeResult{ProtocolVersion: mcp.LATEST_PROTOCOL_VERSION})
+		if err != nil {
+			return nil, err
+		}
+		response.Result = result
+		return response, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail[request.Method] {
+		return nil, errors.New("backend unavailable")
+	}
+	data, err := json.Marshal(request.Params)
+	if err != nil {
+		return nil, err
+	}
+	var params struct {
+		URI string `json:"uri"`
+	}
+	if err = json.Unmarshal(data, &params); err != nil {
+		return nil, err
+	}
+	f.calls = append(f.calls, request.Method+" "+params.URI)
+	return response, nil
+}
+
+func (f *fakeTransport) SendNotification(context.Context, mcp.JSONRPCNotification) error { return nil }
+
+func (f *fakeTransport) SetNotificationHandler(func(mcp.JSONRPCNotification)) {}
+
+func (f *fakeTransport) Close() error { return nil }
+
+func (f *fakeTransport) GetSessionId() string { return "" }
+
+// takeCalls 返回并清空记录的后端请求
+func (f *fakeTransport) takeCalls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := f.calls
+	f.calls = nil
+	return calls
+}
+
+// subscriptionServer 创建一个资源都属于同一个已连接后端的路由服务器，并注册给定的下游会话
+func subscriptionServer(t *testing.T, sessions ...string) (*Server, *fakeTransport) {
+	t.Helper()
+	fake := &fakeTransport{fail: make(map[string]bool)}
+	mcpClient := client.NewClient(fake)
+	if err := mcpClient.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mcpClient.Initialize(context.Background(), mcp.InitializeRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{name: "a", state: ClientStateReady, client: mcpClient}
+	s := newMCPServer("a", "1", "http://localhost", &Options{Transports: []MCPServerType{MCPServerTypeStreamable}})
+	s.resourceOwner = func(string) (*Client, bool) {
+		return c, true
+	}
+	for _, sessionID := range sessions {
+		s.openSubscriptions(sessionID)
+	}
+	return s, fake
+}
+
+func TestParseSubscriptionRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantMethod mcp.MCPMethod
+		wantURI    string
+		wantErr    bool
+	}{
+		{name: "subscribe", body: `{"jsonrpc":"2.0","id":1,"method":"resources/subscribe","params":{"uri":"file:///a"}}`, wantMethod: methodResourcesSubscribe, wantURI: "file:///a"},
+		{name: "unsubscribe", body: `{"jsonrpc":"2.0","id":"x","method":"resources/unsubscribe","params":{"uri":"file:///a"}}`, wantMethod: methodResourcesUnsubscribe, wantURI: "file:///a"},
+		{name: "notification", body: `{"jsonrpc":"2.0","method":"resources/subscribe","params":{"uri":"file:///a"}}`},
+		{name: "other method", body: `{"jsonrpc":"2.0","id":1,"method":"resources/read","params":{"uri":"file:///a"}}`},
+		{name: "invalid json", body: `{"jsonrpc":`},
+		{name: "batch without subscriptions", body: `[{"jsonrpc":"2.0","id":1,"method":"ping"}]`},
+		{name: "batch with subscription", body: ` [{"jsonrpc":"2.0","id":1,"method":"ping"},{"jsonrpc":"2.0","id":2,"method":"resources/subscribe","params":{"uri":"file:///a"}}]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := parseSubscriptionRequest([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSubscriptionRequest error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantMethod == "" {
+				if request != nil {
+					t.Errorf("parseSubscriptionRequest = %+v, want nil", request)
+				}
+				return
+			}
+			if request == nil || request.Method != tt.wantMethod || request.Params.URI != tt.wantURI {
+				t.Errorf("parseSubscriptionRequest = %+v, want %s %s", request, tt.wantMethod, tt.wantURI)
+			}
+		})
+	}
+}
+
+func TestSubscriptionRefcount(t *testing.T) {
+	type step struct {
+		session string
+		method  mcp.MCPMethod
+		uri     string
+	}
+	tests := []struct {
+		name      string
+		steps     []step
+		close     []string
+		wantCalls []string
+	}{
+		{
+			name: "shared subscription",
+			steps: []step{
+				{"s1", methodResourcesSubscribe, "file:///a"},
+				{"s2", methodResourcesSubscribe, "file:///a"},
+				{"s1", methodResourcesUnsubscribe, "file:///a"},
+				{"s2", methodResourcesUnsubscribe, "file:///a"},
+			},
+			wantCalls: []string{"resources/subscribe file:///a", "resources/unsubscribe file:///a"},
+		},
+		{
+			name: "repeated subscribe from one session",
+			steps: []step{
+				{"s1", methodResourcesSubscribe, "file:///a"},
+				{"s1", methodResourcesSubscribe, "file:///a"},
+				{"s1", methodResourcesUnsubscribe, "file:///a"},
+				{"s1", methodResourcesUnsubscribe, "file:///a"},
+			},
+			wantCalls: []string{"resources/subscribe file:///a", "resources/unsubscribe file:///a"},
+		},
+		{
+			name: "unsubscribe without subscription",
+			steps: []step{
+				{"s1", methodResourcesUnsubscribe, "file:///a"},
+			},
+		},
+		{
+			name: "session close releases its subscriptions",
+			steps: []step{
+				{"s1", methodResourcesSubscribe, "file:///a"},
+				{"s1", methodResourcesSubscribe, "file:///b"},
+				{"s2", methodResourcesSubscribe, "file:///b"},
+			},
+			close:     []string{"s1"},
+			wantCalls: []string{"resources/subscribe file:///a", "resources/subscribe file:///b", "resources/unsubscribe file:///a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, fake := subscriptionServer(t, "s1", "s2")
+			for _, step := range tt.steps {
+				request := &subscriptionRequest{ID: new(mcp.RequestId), Method: step.method}
+				request.Params.URI = step.uri
+				if response, ok := s.handleSubscription(context.Background(), step.session, request).(mcp.JSONRPCError); ok {
+					t.Fatalf("%s %s from %s: %v", step.method, step.uri, step.session, response.Error)
+				}
+			}
+			for _, sessionID := range tt.close {
+				s.closeSubscriptions(sessionID)
+			}
+			calls := fake.takeCalls()
+			slices.Sort(calls)
+			slices.Sort(tt.wantCalls)
+			if !slices.Equal(calls, tt.wantCalls) {
+				t.Errorf("backend calls = %q, want %q", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestUnsubscribeFailureKeepsSubscription(t *testing.T) {
+	s, fake := subscriptionServer(t, "s1")
+	ctx := context.Background()
+	if err := s.subscribe(ctx, "s1", "file:///a"); err != nil {
+		t.Fatal(err)
+	}
+	fake.fail["resources/unsubscribe"] = true
+	if err := s.unsubscribe(ctx, "s1", "file:///a"); err == nil {
+		t.Fatal("unsubscribe succeeded while the backend failed")
+	}
+	if _, ok := s.subscriptions["s1"]["file:///a"]; !ok {
+		t.Fatal("subscription removed after a failed unsubscribe")
+	}
+	fake.fail["resources/unsubscribe"] = false
+	if err := s.unsubscribe(ctx, "s1", "file:///a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.subscriptions["s1"]["file:///a"]; ok {
+		t.Error("subscription kept after a successful unsubscribe")
+	}
+	want := []string{"resources/subscribe file:///a", "resources/unsubscribe file:///a"}
+	if calls := fake.takeCalls(); !slices.Equal(calls, want) {
+		t.Errorf("backend calls = %q, want %q", calls, want)
+	}
+}
+
+func TestSubscribeAfterSessionClosed(t *testing.T) {
+	s, fake := subscriptionServer(t)
+	if err := s.subscribe(context.Background(), "gone", "file:///a"); !errors.Is(err, errSessionClosed) {
+		t.Fatalf("subscribe = %v, want %v", err, errSessionClosed)
+	}
+	if len(s.subscriptions) != 0 {
+		t.Errorf("subscriptions = %v, want none", s.subscriptions)
+	}
+	want := []string{"resources/subscribe file:///a", "resources/unsubscribe file:///a"}
+	if calls := fake.takeCalls(); !slices.Equal(calls, want) {
+		t.Errorf("backend calls = %q, want %q", calls, want)
+	}
+}
+
+func TestInterceptSubscriptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		session    string
+		body       string
+		wantStatus int
+		wantBody   string
+		wantNext   bool
+	}{
+		{
+			name:       "subscribe is answered directly",
+			session:    "s1",
+			body:       `{"jsonrpc":"2.0","id":7,"method":"resources/subscribe","params":{"uri":"file:///a"}}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `{"jsonrpc":"2.0","id":7,"result":{}}`,
+		},
+		{
+			name:       "missing uri",
+			session:    "s1",
+			body:       `{"jsonrpc":"2.0","id":7,"method":"resources/subscribe","params":{}}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `"code":-32602`,
+		},
+		{
+			name:       "unknown session",
+			session:    "s2",
+			body:       `{"jsonrpc":"2.0","id":7,"method":"resources/subscribe","params":{"uri":"file:///a"}}`,
+			wantStatus: http.StatusNotFound,
+			wantBody:   "Invalid session ID",
+		},
+		{
+			name:       "batch is rejected",
+			session:    "s1",
+			body:       `[{"jsonrpc":"2.0","id":7,"method":"resources/subscribe","params":{"uri":"file:///a"}}]`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "batch",
+		},
+		{
+			name:       "other requests pass through",
+			session:    "s1",
+			body:       `{"jsonrpc":"2.0","id":7,"method":"resources/read","params":{"uri":"file:///a"}}`,
+			wantStatus: http.StatusTeapot,
+			wantNext:   true,
+		},
+		{
+			name:       "large requests pass through unbuffered",
+			session:    "s1",
+			body:       `{"jsonrpc":"2.0","id":7,"method":"tools/call","params":{"name":"x","arguments":{"data":"` + strings.Repeat("a", maxSubscriptionRequestSize) + `"}}}`,
+			wantStatus: http.StatusTeapot,
+			wantNext:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := subscriptionServer(t, "s1")
+			var passed string
+			handler := s.interceptSubscriptions("/a/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				passed = string(body)
+				w.WriteHeader(http.StatusTeapot)
+			}))
+			r := httptest.NewRequest(http.MethodPost, "/a/mcp", strings.NewReader(tt.body))
+			r.Header.Set(server.HeaderKeySessionID, tt.session)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", w.Body.String(), tt.wantBody)
+			}
+			if want := map[bool]string{true: tt.body}[tt.wantNext]; passed != want {
+				t.Errorf("body passed to next = %q, want %q", passed, want)
+			}
+		})
+	}
+}
+
+func TestSubscribeUnauthorized(t *testing.T) {
+	s, fake := subscriptionServer(t, "s1")
+	c, _ := s.resourceOwner("file:///a")
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	c.audit = newAuditLogger(&AuditConfig{File: auditFile})
+	defer c.audit.Close()
+
+	handler := s.interceptSubscriptions("/a/", http.NotFoundHandler())
+	body := `{"jsonrpc":"2.0","id":7,"method":"resources/subscribe","params":{"uri":"file:///a"}}`
+	r := httptest.NewRequest(http.MethodPost, "/a/mcp", strings.NewReader(body))
+	r.Header.Set(server.HeaderKeySessionID, "s1")
+	identity := &Identity{Principal: "reader", scopes: parseScopes([]string{"b"})}
+	r = r.WithContext(withIdentity(r.Context(), identity))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if !strings.Contains(w.Body.String(), "caller reader is not allowed to access a") {
+		t.Errorf("body = %q, want an authorization error", w.Body.String())
+	}
+	if calls := fake.takeCalls(); len(calls) != 0 {
+		t.Errorf("backend calls = %q, want none", calls)
+	}
+	if len(s.subscriptions["s1"]) != 0 {
+		t.Errorf("subscriptions = %v, want none", s.subscriptions)
+	}
+	data, err := os.ReadFile(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record AuditRecord
+	if err = json.Unmarshal(data, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Method != string(methodResourcesSubscribe) || record.URI != "file:///a" || record.Session != "s1" ||
+		record.Identity == nil || record.Identity.Principal != "reader" || record.Error == "" {
+		t.Errorf("audit record = %+v, want a denied subscription by reader", record)
+	}
+}
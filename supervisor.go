@@ -0,0 +1,323 @@
+// supervisor.go 文件实现了后端客户端的监督任务。
+// 它定期 ping 后端并监听连接断开事件，在后端失效时按照重启策略以指数退避的方式重新连接，
+// 重连成功后会把新的能力列表同步到已有的 MCP 服务器上，下游客户端无需重新连接。
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mark3labs/mcp-go/client/transport"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+const (
+	pingInterval         = 30 * time.Second // ping 后端的间隔
+	pingTimeout          = 10 * time.Second // 单次 ping 的超时时间
+	pingFailureThreshold = 3                // 连续 ping 失败多少次后认为后端已失效
+	initialBackoff       = time.Second      // 第一次重连前的等待时间
+	maxBackoff           = time.Minute      // 重连等待时间的上限
+	stopTimeout          = 5 * time.Second  // 关闭 stdio 子进程时默认等待其退出的时间，超时后强制结束
+)
+
+// ClientState 表示后端客户端的连接状态
+type ClientState string
+
+// 后端客户端连接状态常量
+const (
+	ClientStateConnecting   ClientState = "connecting"   // 正在进行首次连接
+	ClientStateReady        ClientState = "ready"        // 已连接，可以处理请求
+	ClientStateReconnecting ClientState = "reconnecting" // 连接已断开，正在重新连接
+	ClientStateFailed       ClientState = "failed"       // 连接失败且不会再重试
+	ClientStateStopped      ClientState = "stopped"      // 后端正常退出或客户端已关闭
+	ClientStateDisabled     ClientState = "disabled"     // 后端已被手动禁用
+	ClientStateIdle         ClientState = "idle"         // 按需启动的后端当前没有运行，收到调用时启动
+)
+
+// ClientStatus 是客户端状态的快照，会以 JSON 的形式返回给调用方
+type ClientStatus struct {
+	Name        string      `json:"name"`                  // 客户端名称
+	State       ClientState `json:"state"`                 // 当前连接状态
+	LastError   string      `json:"lastError,omitempty"`   // 最近一次连接失败或断开的原因
+	NextRetry   *time.Time  `json:"nextRetry,omitempty"`   // 下一次重连的时间
+	ConnectedAt *time.Time  `json:"connectedAt,omitempty"` // 最近一次成功连接的时间
+	Restarts    int         `json:"restarts"`              // 累计重连次数
+	Sessions    int         `json:"sessions,omitempty"`    // 下游会话专属的连接或子进程数量
+}
+
+// addToMCPServer 连接到后端 MCP 服务，将其能力（工具、提示、资源等）注册到代理的 MCP 服务器实例上，
+// 并启动监督任务，在后端失效时自动重连
+// 首次连接失败时会返回错误，但监督任务仍会按照重启策略在后台重试
+func (c *Client) addToMCPServer(ctx context.Context, clientInfo mcp.Implementation, mcpServer *server.MCPServer) error {
+	c.clientInfo = clientInfo
+	c.ctx = ctx
+	c.attach(newRegistry(c.name, "", mcpServer))
+	if c.lazy != nil {
+		c.loadCatalog()
+	}
+	return c.start()
+}
+
+// start 连接到后端并启动监督任务，连接失败时监督任务会按照重启策略在后台重试
+func (c *Client) start() error {
+	superviseCtx, cancel := context.WithCancel(c.ctx)
+	supervised := make(chan struct{})
+	c.mu.Lock()
+	c.cancel = cancel
+	c.supervised = supervised
+	c.mu.Unlock()
+
+	// 按需启动的后端已有能力列表时直接进入空闲状态，否则先启动一次进程获取能力列表
+	c.mu.RLock()
+	cached := c.catalog != nil
+	c.mu.RUnlock()
+	var err error
+	if c.lazy != nil && cached {
+		c.setState(ClientStateIdle)
+	} else {
+		err = c.connect(superviseCtx)
+	}
+	if err != nil {
+		c.mu.Lock()
+		c.lastErr = err
+		c.mu.Unlock()
+	} else if c.lazy != nil && !c.isIdle() {
+		log.Printf("<%s> Discovered capabilities, stopping until the first call", c.name)
+		c.sleep(nil)
+	}
+	go func() {
+		defer close(supervised)
+		c.supervise(superviseCtx, err)
+	}()
+	return err
+}
+
+// stopSupervisor 停止监督任务并等待它退出
+func (c *Client) stopSupervisor() {
+	c.mu.RLock()
+	cancel, supervised := c.cancel, c.supervised
+	c.mu.RUnlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-supervised
+}
+
+// restartNow 立即断开并重新连接后端，不受重启策略的限制，并重新计算重启次数
+// 用于手动重启失效的后端，或者重新启用已禁用的后端
+func (c *Client) restartNow() error {
+	if c.ctx == nil {
+		return fmt.Errorf("backend %s has not been started", c.name)
+	}
+	c.stopSupervisor()
+	c.disconnect(errors.New("restart requested"))
+	c.mu.Lock()
+	c.restarts = 0
+	c.state = ClientStateConnecting
+	c.mu.Unlock()
+	log.Printf("<%s> Restarting", c.name)
+	if _, ok := c.config.(*StdioMCPClientConfig); ok {
+		stdioRestartsTotal.WithLabelValues(c.name).Inc()
+	}
+	return c.start()
+}
+
+// disable 停止监督任务并断开后端，同时从所有注册表中移除它的能力，直到再次重启
+func (c *Client) disable() {
+	c.stopSupervisor()
+	c.disconnect(nil)
+	c.mu.Lock()
+	c.state = ClientStateDisabled
+	c.catalog = nil
+	c.mu.Unlock()
+	log.Printf("<%s> Disabled", c.name)
+	c.syncRegistries()
+}
+
+// supervise 定期 ping 后端并监听连接断开事件，后端失效时按照重启策略重新连接
+// 对于 stdio 后端，子进程退出后 ping 会立即返回传输已关闭的错误，从而触发重启
+// initErr 不为空时表示首次连接失败，会先按照重启策略重试连接
+// 按需启动的后端空闲时等待调用请求启动进程，运行时在空闲超时后停止进程，失效时只停止进程而不在后台重连
+func (c *Client) supervise(ctx context.Context, initErr error) {
+	var idleTimer *time.Timer
+	var idle <-chan time.Time
+	if c.lazy != nil {
+		defer c.lazy.abort(fmt.Errorf("backend %s is stopped", c.name))
+		idleTimer = time.NewTimer(c.lazy.idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	if initErr != nil && !c.restart(ctx, initErr) {
+		return
+	}
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		if c.lazy != nil && c.isIdle() {
+			if !c.wakeUp(ctx) {
+				return
+			}
+			idleTimer.Reset(c.lazy.idleTimeout)
+			continue
+		}
+		var cause error
+		select {
+		case <-ctx.Done():
+			log.Printf("<%s> Context done, stopping supervisor", c.name)
+			return
+		case <-idle:
+			idleTimer.Reset(c.sleepIfIdle())
+			continue
+		case cause = <-c.lost:
+			log.Printf("<%s> Connection lost: %v", c.name, cause)
+		case <-ticker.C:
+			err := c.ping(ctx)
+			if err == nil {
+				failures = 0
+				continue
+			}
+			failures++
+			pingFailuresTotal.WithLabelValues(c.name).Inc()
+			log.Printf("<%s> Ping failed (%d/%d): %v", c.name, failures, pingFailureThreshold, err)
+			// 传输层已关闭时无需等待达到失败阈值
+			if failures < pingFailureThreshold && !errors.Is(err, transport.ErrTransportClosed) {
+				continue
+			}
+			cause = err
+		}
+		failures = 0
+		if c.lazy != nil {
+			// 按需启动的后端不在后台重连，下一次调用时再启动
+			c.sleep(cause)
+			continue
+		}
+		if !c.restart(ctx, cause) {
+			return
+		}
+	}
+}
+
+// ping 向当前的底层客户端发送一次 ping 请求
+func (c *Client) ping(ctx context.Context) error {
+	mcpClient, err := c.currentClient()
+	if err != nil {
+		return err
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	return mcpClient.Ping(pingCtx)
+}
+
+// restart 关闭失效的底层客户端，并按照重启策略以指数退避的方式重新连接
+// 返回 false 表示不再重连，监督任务应当退出
+func (c *Client) restart(ctx context.Context, cause error) bool {
+	cleanExit := c.disconnect(cause)
+	restartConfig := c.currentOptions().Restart
+
+	switch {
+	case restartConfig.Policy == RestartPolicyNever:
+		log.Printf("<%s> Restart policy is %s, not reconnecting", c.name, restartConfig.Policy)
+		c.setState(ClientStateFailed)
+		return false
+	case restartConfig.Policy == RestartPolicyOnFailure && cleanExit:
+		log.Printf("<%s> Backend exited cleanly, not restarting with policy %s", c.name, restartConfig.Policy)
+		c.setState(ClientStateStopped)
+		return false
+	}
+
+	backoff := initialBackoff
+	for {
+		c.mu.Lock()
+		if restartConfig.MaxRestarts > 0 && c.restarts >= restartConfig.MaxRestarts {
+			c.state = ClientStateFailed
+			c.mu.Unlock()
+			log.Printf("<%s> Reached max restarts (%d), giving up", c.name, restartConfig.MaxRestarts)
+			return false
+		}
+		c.restarts++
+		attempt := c.restarts
+		c.mu.Unlock()
+
+		log.Printf("<%s> Reconnecting in %s (restart #%d)", c.name, backoff, attempt)
+		c.mu.Lock()
+		c.nextRetry = time.Now().Add(backoff)
+		c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+
+		err := c.connect(ctx)
+		reconnectsTotal.WithLabelValues(c.name, resultLabel(err)).Inc()
+		if _, ok := c.config.(*StdioMCPClientConfig); ok {
+			stdioRestartsTotal.WithLabelValues(c.name).Inc()
+		}
+		if err == nil {
+			log.Printf("<%s> Reconnected", c.name)
+			return true
+		}
+		log.Printf("<%s> Failed to reconnect: %v", c.name, err)
+		c.mu.Lock()
+		c.lastErr = err
+		c.mu.Unlock()
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// disconnect 关闭当前的底层客户端并记录断开原因
+// 返回后端是否正常退出，只有 stdio 子进程以 0 状态退出时才为 true
+func (c *Client) disconnect(cause error) bool {
+	c.mu.Lock()
+	mcpClient, cmd := c.client, c.cmd
+	c.client, c.cmd = nil, nil
+	// 从未连接成功过的后端仍处于首次连接状态
+	if !c.connectedAt.IsZero() {
+		c.state = ClientStateReconnecting
+	}
+	c.lastErr = cause
+	c.mu.Unlock()
+
+	if mcpClient != nil {
+		_ = closeMCPClient(mcpClient, cmd, c.killTimeout)
+	}
+	return cmd != nil && cmd.ProcessState != nil && cmd.ProcessState.Success()
+}
+
+// setState 更新客户端的连接状态
+func (c *Client) setState(state ClientState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = state
+}
+
+// status 返回客户端状态的快照
+func (c *Client) status() ClientStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	status := ClientStatus{
+		Name:     c.name,
+		State:    c.state,
+		Restarts: c.restarts,
+		Sessions: c.sessions.count(),
+	}
+	if c.lastErr != nil {
+		status.LastError = c.lastErr.Error()
+	}
+	if !c.connectedAt.IsZero() {
+		connectedAt := c.connectedAt
+		status.ConnectedAt = &connectedAt
+	}
+	if c.state != ClientStateReady && !c.nextRetry.IsZero() {
+		nextRetry := c.nextRetry
+		status.NextRetry = &nextRetry
+	}
+	return status
+}
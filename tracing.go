@@ -0,0 +1,202 @@
+// tracing.go 文件实现了 OpenTelemetry 链路追踪。
+// 每个下游的 JSON-RPC 请求对应一个服务端 span，转发到后端的调用是它的子 span，
+// 转发到 HTTP 类型后端的请求会携带 W3C Trace Context 请求头。
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName 是代理创建 span 时使用的 instrumentation 名称
+const tracerName = "github.com/TBXark/mcp-proxy"
+
+// setupTracing 根据配置创建并注册全局的 TracerProvider 和传播器，返回用于刷新并关闭导出器的函数
+// 未配置链路追踪时使用 OpenTelemetry 默认的空实现，不会产生任何开销
+func setupTracing(ctx context.Context, conf *TracingConfig, version string) (func(context.Context) error, error) {
+	if conf == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch conf.Exporter {
+	case TracingExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case TracingExporterFile:
+		file, openErr := os.OpenFile(conf.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if openErr != nil {
+			return nil, openErr
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		options := make([]otlptracehttp.Option, 0)
+		if conf.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(conf.Endpoint))
+		}
+		if len(conf.Headers) > 0 {
+			options = append(options, otlptracehttp.WithHeaders(conf.Headers))
+		}
+		exporter, err = otlptracehttp.New(ctx, options...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", conf.Exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", conf.ServiceName),
+		attribute.String("service.version", version),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio.OrElse(1)))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// tracer 返回代理使用的 Tracer
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// jsonrpcEnvelope 是从请求体中解析出的 JSON-RPC 消息概要，用于命名 span
+type jsonrpcEnvelope struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params struct {
+		Name string `json:"name,omitempty"`
+		URI  string `json:"uri,omitempty"`
+	} `json:"params"`
+}
+
+// tracingMiddleware 创建一个中间件，为每个 POST 到路由的 JSON-RPC 消息创建服务端 span。
+// 带 id 的请求由 MCP 服务器的钩子在处理完成后结束 span，这样 SSE 传输先返回 202、
+// 再异步处理消息时，span 也能覆盖完整的处理过程；通知和出错的请求在响应后立即结束 span。
+func tracingMiddleware(route string) MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// GET 请求用于打开长连接，DELETE 请求用于结束会话，都不对应 JSON-RPC 消息
+			if r.Method != http.MethodPost {
+				next.ServeHTTP(w, r)
+				return
+			}
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+			if err != nil {
+				writeBodyError(w, err)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			name := "batch"
+			var message jsonrpcEnvelope
+			batch := len(bytes.TrimSpace(body)) > 0 && bytes.TrimSpace(body)[0] == '['
+			if !batch && json.Unmarshal(body, &message) == nil && message.Method != "" {
+				name = message.Method
+				if target := message.Params.Name; target != "" {
+					name += " " + target
+				}
+			}
+
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer().Start(ctx, name,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("mcp.route", route),
+					attribute.String("mcp.method.name", message.Method),
+				),
+			)
+			if sessionID := sessionIDFromRequest(r); sessionID != "" {
+				span.SetAttributes(attribute.String("mcp.session.id", sessionID))
+			}
+			if len(message.ID) > 0 {
+				span.SetAttributes(attribute.String("jsonrpc.request.id", string(message.ID)))
+			}
+			if message.Params.URI != "" {
+				span.SetAttributes(attribute.String("mcp.resource.uri", message.Params.URI))
+			}
+
+			recorder := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(recorder, r.WithContext(ctx))
+
+			span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+			if recorder.status >= http.StatusBadRequest {
+				span.SetStatus(codes.Error, http.StatusText(recorder.status))
+			}
+			// SSE 传输对请求返回 202 后才异步处理，由钩子结束 span；重复调用 End 不会有影响
+			if recorder.status != http.StatusAccepted || len(message.ID) == 0 {
+				span.End()
+			}
+		})
+	}
+}
+
+// sessionIDFromRequest 返回请求所属的 MCP 会话 ID，SSE 传输放在查询参数中，Streamable HTTP 放在请求头中
+func sessionIDFromRequest(r *http.Request) string {
+	if sessionID := r.Header.Get(server.HeaderKeySessionID); sessionID != "" {
+		return sessionID
+	}
+	return r.URL.Query().Get("sessionId")
+}
+
+// addTracingHooks 注册在请求处理完成时结束服务端 span 的钩子
+func addTracingHooks(hooks *server.Hooks) {
+	hooks.AddOnSuccess(func(ctx context.Context, id any, method mcp.MCPMethod, message any, result any) {
+		trace.SpanFromContext(ctx).End()
+	})
+	hooks.AddOnError(func(ctx context.Context, id any, method mcp.MCPMethod, message any, err error) {
+		span := trace.SpanFromContext(ctx)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+	})
+}
+
+// startBackendSpan 为转发到后端的调用创建客户端 span
+func startBackendSpan(ctx context.Context, backend, method string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("mcp.backend", backend),
+			attribute.String("mcp.method.name", method),
+		),
+	)
+}
+
+// endSpan 记录调用结果并结束 span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceHeaders 返回需要携带到 HTTP 类型后端的 W3C Trace Context 请求头
+func traceHeaders(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
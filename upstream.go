@@ -0,0 +1,325 @@
+// upstream.go 文件实现了代理访问 HTTP 后端时携带的凭据。
+// 访问令牌可以通过客户端凭据或刷新令牌获取，缓存到过期前；后端返回 401 时丢弃缓存的令牌，
+// 重新获取后重试一次请求。也可以按模板把下游调用方的身份或凭据转发给后端。
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// upstreamAuth 为发往后端的请求注入访问令牌，实现了 http.RoundTripper
+type upstreamAuth struct {
+	name string             // 后端名称，用于日志
+	base oauth2.TokenSource // 每次调用都会向授权服务器申请新的令牌
+	next http.RoundTripper
+
+	mu      sync.Mutex
+	source  oauth2.TokenSource // 缓存令牌直到过期
+	current *oauth2.Token      // source 最近一次返回的令牌，用于判断被拒绝的令牌是否已被替换
+}
+
+// newUpstreamAuth 根据配置创建后端认证，未配置时返回 nil
+func newUpstreamAuth(name string, conf *UpstreamAuthConfig) *upstreamAuth {
+	if conf == nil {
+		return nil
+	}
+	ctx := context.Background()
+	var base oauth2.TokenSource
+	switch conf.Grant {
+	case OAuthGrantClientCredentials:
+		credentials := &clientcredentials.Config{
+			ClientID:       conf.ClientID,
+			ClientSecret:   conf.ClientSecret,
+			TokenURL:       conf.TokenURL,
+			Scopes:         conf.Scopes,
+			EndpointParams: make(map[string][]string, len(conf.Params)),
+		}
+		for key, value := range conf.Params {
+			credentials.EndpointParams.Set(key, value)
+		}
+		// credentials.TokenSource 自带缓存，无法丢弃被拒绝的令牌，这里每次都直接申请
+		base = tokenSourceFunc(func() (*oauth2.Token, error) {
+			return credentials.Token(ctx)
+		})
+	case OAuthGrantRefreshToken:
+		base = &refreshTokenSource{
+			ctx: ctx,
+			config: &oauth2.Config{
+				ClientID:     conf.ClientID,
+				ClientSecret: conf.ClientSecret,
+				Endpoint:     oauth2.Endpoint{TokenURL: conf.TokenURL},
+				Scopes:       conf.Scopes,
+			},
+			refreshToken: conf.RefreshToken,
+		}
+	}
+	return &upstreamAuth{
+		name:   name,
+		base:   base,
+		next:   http.DefaultTransport,
+		source: oauth2.ReuseTokenSource(nil, base),
+	}
+}
+
+// token 返回缓存的访问令牌，缓存为空或即将过期时重新获取，获取期间不持有 a.mu
+func (a *upstreamAuth) token() (*oauth2.Token, error) {
+	a.mu.Lock()
+	source := a.source
+	a.mu.Unlock()
+	token, err := source.Token()
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	if a.source == source {
+		a.current = token
+	}
+	a.mu.Unlock()
+	return token, nil
+}
+
+// invalidate 丢弃被后端拒绝的令牌，其他请求已经换成新令牌时不做任何事
+// 只与缓存的令牌比较，不会在持有锁时向授权服务器申请令牌
+func (a *upstreamAuth) invalidate(rejected *oauth2.Token) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.current != nil && a.current.AccessToken != rejected.AccessToken {
+		return
+	}
+	a.source = oauth2.ReuseTokenSource(nil, a.base)
+	a.current = nil
+}
+
+// RoundTrip 为请求附加访问令牌，后端返回 401 时重新获取令牌并重试一次
+func (a *upstreamAuth) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := a.token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get access token: %w", err)
+	}
+	resp, err := a.next.RoundTrip(withAccessToken(req, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	// 请求体无法重放时只能把 401 交给调用方
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+
+	log.Printf("<%s> Backend rejected the access token, re-authenticating", a.name)
+	a.invalidate(token)
+	if token, err = a.token(); err != nil {
+		log.Printf("<%s> Failed to get access token: %v", a.name, err)
+		return resp, nil
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return a.next.RoundTrip(withAccessToken(retry, token))
+}
+
+// withAccessToken 返回携带访问令牌的请求副本，RoundTripper 不能修改原始请求
+func withAccessToken(req *http.Request, token *oauth2.Token) *http.Request {
+	req = req.Clone(req.Context())
+	token.SetAuthHeader(req)
+	return req
+}
+
+// httpClient 返回使用该认证的 HTTP 客户端
+func (a *upstreamAuth) httpClient() *http.Client {
+	return &http.Client{Transport: a}
+}
+
+// tokenSourceFunc 把函数适配为 oauth2.TokenSource
+type tokenSourceFunc func() (*oauth2.Token, error)
+
+// Token 调用函数获取令牌
+func (f tokenSourceFunc) Token() (*oauth2.Token, error) {
+	return f()
+}
+
+// refreshTokenSource 使用刷新令牌获取访问令牌，授权服务器轮换刷新令牌时保存新的刷新令牌
+type refreshTokenSource struct {
+	ctx    context.Context
+	config *oauth2.Config
+
+	mu           sync.Mutex
+	refreshToken string
+}
+
+// Token 使用当前的刷新令牌获取新的访问令牌
+func (s *refreshTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, err := s.config.TokenSource(s.ctx, &oauth2.Token{RefreshToken: s.refreshToken}).Token()
+	if err != nil {
+		return nil, err
+	}
+	if token.RefreshToken != "" {
+		s.refreshToken = token.RefreshToken
+	}
+	return token, nil
+}
+
+// forwardData 是渲染转发请求头模板时可以使用的数据
+type forwardData struct {
+	Caller    string      // 调用方名称，依次为具名调用方、JWT 主体和令牌哈希
+	Principal string      // 具名调用方的名称
+	Subject   string      // JWT 或令牌内省得到的主体
+	TokenHash string      // 下游令牌的哈希值
+	Header    http.Header // 下游请求的请求头
+}
+
+// headerForwarder 根据下游请求渲染发往后端的请求头
+type headerForwarder struct {
+	headers map[string]*template.Template
+	secrets *secretsFile
+}
+
+// newHeaderForwarder 根据配置创建请求头转发，未配置时返回 nil
+// 模板已经在加载配置时校验过，这里不会失败
+func newHeaderForwarder(conf *ForwardConfig) *headerForwarder {
+	if conf == nil {
+		return nil
+	}
+	f := &headerForwarder{}
+	if conf.SecretsFile != "" {
+		f.secrets = &secretsFile{path: conf.SecretsFile}
+	}
+	f.headers, _ = parseForwardHeaders(conf.Headers, f.secret)
+	return f
+}
+
+// parseForwardHeaders 解析请求头模板，secret 为 nil 时只用于校验模板
+func parseForwardHeaders(headers map[string]string, secret func(string) (string, error)) (map[string]*template.Template, error) {
+	if secret == nil {
+		secret = func(string) (string, error) { return "", nil }
+	}
+	funcs := template.FuncMap{"secret": secret}
+	templates := make(map[string]*template.Template, len(headers))
+	for name, text := range headers {
+		tmpl, err := template.New(name).Option("missingkey=error").Funcs(funcs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for header %s: %w", name, err)
+		}
+		templates[name] = tmpl
+	}
+	return templates, nil
+}
+
+// render 使用上下文中的调用方身份和下游请求头渲染请求头，渲染结果为空的请求头不会发送
+func (f *headerForwarder) render(ctx context.Context) (map[string]string, error) {
+	data := forwardData{Header: requestHeaderFromContext(ctx)}
+	if identity := identityFromContext(ctx); identity != nil {
+		data.Caller = identity.caller()
+		data.Principal = identity.Principal
+		data.Subject = identity.Subject
+		data.TokenHash = identity.TokenHash
+	}
+	if data.Header == nil {
+		data.Header = http.Header{}
+	}
+	headers := make(map[string]string, len(f.headers))
+	for name, tmpl := range f.headers {
+		var value strings.Builder
+		if err := tmpl.Execute(&value, data); err != nil {
+			return nil, fmt.Errorf("header %s: %w", name, err)
+		}
+		if rendered := strings.TrimSpace(value.String()); rendered != "" {
+			headers[name] = rendered
+		}
+	}
+	return headers, nil
+}
+
+// secret 返回密钥文件中给定键的值，找不到时返回错误，调用会因此失败
+func (f *headerForwarder) secret(key string) (string, error) {
+	if f.secrets == nil {
+		return "", errors.New("secretsFile is not configured")
+	}
+	return f.secrets.get(key)
+}
+
+// headersKey 返回请求头的摘要，用于判断会话连接使用的凭据是否发生了变化
+func headersKey(headers map[string]string) string {
+	hash := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(headers)) {
+		_, _ = fmt.Fprintf(hash, "%s\x00%s\x00", name, headers[name])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// secretsFile 是 JSON 对象格式的密钥文件，文件的修改时间变化后重新读取
+type secretsFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	values  map[string]string
+}
+
+// get 返回给定键的值
+func (s *secretsFile) get(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return "", err
+	}
+	if s.values == nil || !info.ModTime().Equal(s.modTime) {
+		data, err := os.ReadFile(s.path)
+		if err != nil {
+			return "", err
+		}
+		values := make(map[string]string)
+		if err = json.Unmarshal(data, &values); err != nil {
+			return "", fmt.Errorf("invalid secrets file %s: %w", s.path, err)
+		}
+		s.values, s.modTime = values, info.ModTime()
+	}
+	value, ok := s.values[key]
+	if !ok {
+		// 错误信息中不包含密钥的值，只包含键
+		return "", fmt.Errorf("no secret for %q", key)
+	}
+	return value, nil
+}
+
+// requestHeaderKey 是下游请求头在上下文中的键
+type requestHeaderKey struct{}
+
+// requestHeaderMiddleware 把下游请求的请求头放入上下文，供转发调用方凭据时使用
+func requestHeaderMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), requestHeaderKey{}, r.Header.Clone())
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestHeaderFromContext 返回上下文中的下游请求头，不存在时返回 nil
+func requestHeaderFromContext(ctx context.Context) http.Header {
+	header, _ := ctx.Value(requestHeaderKey{}).(http.Header)
+	return header
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// countingAuth 返回一个每次申请都签发新令牌的后端认证
+func countingAuth(issued *atomic.Int32) *upstreamAuth {
+	base := tokenSourceFunc(func() (*oauth2.Token, error) {
+		n := issued.Add(1)
+		return &oauth2.Token{AccessToken: fmt.Sprintf("token-%d", n), Expiry: time.Now().Add(time.Hour)}, nil
+	})
+	return &upstreamAuth{name: "test", base: base, next: http.DefaultTransport, source: oauth2.ReuseTokenSource(nil, base)}
+}
+
+func TestUpstreamAuthInvalidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		rejected   string
+		wantToken  string
+		wantIssued int32
+	}{
+		{"current token is replaced", "token-1", "token-2", 2},
+		{"stale token is ignored", "token-0", "token-1", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var issued atomic.Int32
+			a := countingAuth(&issued)
+			if _, err := a.token(); err != nil {
+				t.Fatal(err)
+			}
+			a.invalidate(&oauth2.Token{AccessToken: tt.rejected})
+			if n := issued.Load(); n != 1 {
+				t.Fatalf("invalidate fetched a token: issued = %d", n)
+			}
+			token, err := a.token()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.AccessToken != tt.wantToken {
+				t.Errorf("token = %q, want %q", token.AccessToken, tt.wantToken)
+			}
+			if n := issued.Load(); n != tt.wantIssued {
+				t.Errorf("issued = %d, want %d", n, tt.wantIssued)
+			}
+		})
+	}
+}
+
+func TestUpstreamAuthRetriesOnUnauthorized(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	var issued atomic.Int32
+	resp, err := countingAuth(&issued).httpClient().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if n := issued.Load(); n != 2 {
+		t.Errorf("issued = %d, want 2", n)
+	}
+}
@@ -0,0 +1,204 @@
+// validate.go 文件实现了 validate 和 schema 子命令。
+// validate 使用随程序发布的 JSON Schema 检查配置文件，再执行加载配置时的校验，并检查 stdio 后端的命令是否存在，
+// 一次性列出所有问题；schema 输出该 JSON Schema，便于在编辑器中补全和检查配置文件。
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/TBXark/confstore"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/santhosh-tekuri/jsonschema/v6/kind"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// configSchemaURL 是配置文件 JSON Schema 的 $id
+const configSchemaURL = "https://github.com/TBXark/mcp-proxy/config.schema.json"
+
+// configSchema 是配置文件的 JSON Schema
+//
+//go:embed config.schema.json
+var configSchema []byte
+
+// runSchema 输出配置文件的 JSON Schema
+func runSchema() int {
+	if _, err := os.Stdout.Write(configSchema); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// runValidate 检查配置文件并输出所有问题，存在问题时返回非零的退出码
+func runValidate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	path := flags.String("config", "config.json", "path to config file or a http(s) url")
+	_ = flags.Parse(args)
+
+	problems, err := validateConfig(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to validate config: %v\n", err)
+		return 1
+	}
+	if len(problems) == 0 {
+		fmt.Printf("%s is valid\n", *path)
+		return 0
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	fmt.Printf("%d problem(s) found in %s\n", len(problems), *path)
+	return 1
+}
+
+// validateConfig 返回配置文件中的所有问题，格式为 "字段路径: 问题"；无法读取或解析配置文件时返回错误
+func validateConfig(path string) ([]string, error) {
+	raw, err := confstore.Load[any](path)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := compileConfigSchema()
+	if err != nil {
+		return nil, err
+	}
+	problems := schemaProblems(schema, *raw)
+
+	// 不符合 JSON Schema 的配置通常也无法加载，这时只报告 JSON Schema 的问题，避免重复
+	conf, err := load(path)
+	if err != nil {
+		if len(problems) == 0 {
+			problems = append(problems, err.Error())
+		}
+		// 加载失败时仍然检查能够解析出的 stdio 命令
+		if conf, err = confstore.Load[Config](path); err != nil {
+			return problems, nil
+		}
+		_ = interpolateConfig(conf)
+	}
+	return append(problems, commandProblems(conf)...), nil
+}
+
+// compileConfigSchema 编译随程序发布的 JSON Schema
+func compileConfigSchema() (*jsonschema.Schema, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(configSchema))
+	if err != nil {
+		return nil, err
+	}
+	compiler := jsonschema.NewCompiler()
+	if err = compiler.AddResource(configSchemaURL, doc); err != nil {
+		return nil, err
+	}
+	return compiler.Compile(configSchemaURL)
+}
+
+// schemaProblems 使用 JSON Schema 检查配置，返回按字段路径排序的问题
+func schemaProblems(schema *jsonschema.Schema, doc any) []string {
+	var validationErr *jsonschema.ValidationError
+	if err := schema.Validate(doc); err == nil {
+		return nil
+	} else if !errors.As(err, &validationErr) {
+		return []string{err.Error()}
+	}
+	printer := message.NewPrinter(language.English)
+	var problems []string
+	var collect func(e *jsonschema.ValidationError)
+	collect = func(e *jsonschema.ValidationError) {
+		switch e.ErrorKind.(type) {
+		case *kind.AnyOf, *kind.OneOf:
+			// 没有任何分支匹配时，合并各个分支的问题，例如既没有 command 也没有 url
+			if len(e.Causes) > 0 {
+				var alternatives []string
+				for _, cause := range e.Causes {
+					alternatives = append(alternatives, leafMessages(cause, printer)...)
+				}
+				problems = append(problems, fmt.Sprintf("%s: %s", instancePath(doc, e.InstanceLocation), strings.Join(alternatives, ", or ")))
+				return
+			}
+		}
+		if len(e.Causes) == 0 {
+			problems = append(problems, fmt.Sprintf("%s: %s", instancePath(doc, e.InstanceLocation), e.ErrorKind.LocalizedString(printer)))
+			return
+		}
+		for _, cause := range e.Causes {
+			collect(cause)
+		}
+	}
+	collect(validationErr)
+	slices.Sort(problems)
+	return slices.Compact(problems)
+}
+
+// leafMessages 返回校验错误中最底层的问题描述
+func leafMessages(e *jsonschema.ValidationError, printer *message.Printer) []string {
+	if len(e.Causes) == 0 {
+		return []string{e.ErrorKind.LocalizedString(printer)}
+	}
+	var messages []string
+	for _, cause := range e.Causes {
+		messages = append(messages, leafMessages(cause, printer)...)
+	}
+	return messages
+}
+
+// instancePath 把 JSON Schema 报告的实例位置转换为与加载配置时的错误一致的字段路径，例如 mcpServers.github.args[0]
+func instancePath(doc any, location []string) string {
+	path := ""
+	for _, token := range location {
+		switch value := doc.(type) {
+		case []any:
+			path = fmt.Sprintf("%s[%s]", path, token)
+			if index, err := strconv.Atoi(token); err == nil && index < len(value) {
+				doc = value[index]
+			}
+		case map[string]any:
+			path = joinConfigPath(path, token)
+			doc = value[token]
+		default:
+			path = joinConfigPath(path, token)
+		}
+	}
+	if path == "" {
+		return "(root)"
+	}
+	return path
+}
+
+// commandProblems 检查 stdio 后端的命令能否在 PATH 或工作目录中找到
+func commandProblems(conf *Config) []string {
+	var problems []string
+	for _, name := range slices.Sorted(maps.Keys(conf.McpServers)) {
+		clientConfig := conf.McpServers[name]
+		if clientConfig == nil || clientConfig.Command == "" {
+			continue
+		}
+		command := clientConfig.Command
+		// 包含路径分隔符的相对路径相对于子进程的工作目录
+		if clientConfig.WorkingDir != "" && strings.ContainsRune(command, filepath.Separator) && !filepath.IsAbs(command) {
+			command = filepath.Join(clientConfig.WorkingDir, command)
+		}
+		if _, err := exec.LookPath(command); err != nil {
+			problems = append(problems, fmt.Sprintf("mcpServers.%s.command: %v", name, unwrapExecError(err)))
+		}
+	}
+	return problems
+}
+
+// unwrapExecError 返回查找命令失败的原因，去掉 exec: 前缀
+func unwrapExecError(err error) error {
+	var execErr *exec.Error
+	if errors.As(err, &execErr) {
+		return fmt.Errorf("%q: %w", execErr.Name, unwrapPathError(execErr.Err))
+	}
+	return err
+}